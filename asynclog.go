@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// asyncWriter is an io.Writer that hands writes to a background goroutine
+// through a buffered channel, so callers never block on the underlying
+// writer. Writes made while the buffer is full are dropped and counted, and
+// writes made after Close are discarded.
+type asyncWriter struct {
+	out     io.Writer
+	lines   chan []byte
+	dropped atomic.Uint64
+
+	// mu guards closed, so Write never sends on the closed lines channel.
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// newAsyncWriter starts an asyncWriter that writes to out, buffering up to
+// size pending writes.
+func newAsyncWriter(out io.Writer, size int) *asyncWriter {
+	w := &asyncWriter{
+		out:   out,
+		lines: make(chan []byte, size),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		for b := range w.lines {
+			w.out.Write(b)
+		}
+	}()
+
+	return w
+}
+
+// Write implements the io.Writer interface. It never blocks; if the buffer is
+// full the write is dropped.
+func (w *asyncWriter) Write(b []byte) (int, error) {
+	line := make([]byte, len(b))
+	copy(line, b)
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return len(b), nil
+	}
+	select {
+	case w.lines <- line:
+	default:
+		w.dropped.Add(1)
+	}
+
+	return len(b), nil
+}
+
+// Dropped returns the number of writes dropped because the buffer was full.
+func (w *asyncWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Close stops accepting writes and blocks until all buffered writes have been
+// flushed to the underlying writer. Handlers still running after shutdown may
+// keep calling Write, which then does nothing.
+func (w *asyncWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// blockingWriter blocks every write until release is closed.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	select {
+	case w.started <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return w.buf.Write(b)
+}
+
+func TestAsyncWriterFlushesOnClose(t *testing.T) {
+	var buf bytes.Buffer
+	w := newAsyncWriter(&buf, 16)
+
+	var want string
+	for i := 0; i < 10; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		want += line
+		io.WriteString(w, line)
+	}
+	w.Close()
+
+	if buf.String() != want {
+		t.Errorf("flushed %q, want %q", buf.String(), want)
+	}
+	if n := w.Dropped(); n != 0 {
+		t.Errorf("dropped %d lines, want 0", n)
+	}
+}
+
+func TestAsyncWriterDropsWhenFull(t *testing.T) {
+	out := &blockingWriter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	w := newAsyncWriter(out, 2)
+
+	// The first line is taken by the goroutine, which then blocks; the next
+	// two fill the buffer and the rest are dropped.
+	io.WriteString(w, "0\n")
+	<-out.started
+	for i := 1; i < 6; i++ {
+		io.WriteString(w, fmt.Sprintf("%d\n", i))
+	}
+	if n := w.Dropped(); n != 3 {
+		t.Errorf("dropped %d lines, want 3", n)
+	}
+
+	close(out.release)
+	w.Close()
+	if got, want := out.buf.String(), "0\n1\n2\n"; got != want {
+		t.Errorf("flushed %q, want %q", got, want)
+	}
+}
+
+func TestAsyncWriterWriteAfterClose(t *testing.T) {
+	var buf bytes.Buffer
+	w := newAsyncWriter(&buf, 4)
+	io.WriteString(w, "before\n")
+	w.Close()
+
+	if n, err := io.WriteString(w, "after\n"); n != len("after\n") || err != nil {
+		t.Errorf("write after close = %d, %v", n, err)
+	}
+	w.Close()
+	if buf.String() != "before\n" {
+		t.Errorf("flushed %q, want only the line written before Close", buf.String())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newFakeClock(start)
+
+	if !c.Now().Equal(start) {
+		t.Fatalf("Now = %s, want %s", c.Now(), start)
+	}
+	if got := c.Advance(time.Minute); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("Advance returned %s, want %s", got, start.Add(time.Minute))
+	}
+	select {
+	case fired := <-c.After(time.Hour):
+		if want := start.Add(time.Hour + time.Minute); !fired.Equal(want) || !c.Now().Equal(want) {
+			t.Errorf("After fired at %s with the clock at %s, want both %s", fired, c.Now(), want)
+		}
+	default:
+		t.Error("After did not fire straight away")
+	}
+}
+
+func TestAccessLogFakeClock(t *testing.T) {
+	cases := []struct {
+		delay string
+		want  string
+	}{
+		{"", `2024/03/01 12:00:00 example.com 192.0.2.1:1234 "GET /timed HTTP/1.1" 200 3 "" 0s`},
+		{"1500ms", `2024/03/01 12:00:01 example.com 192.0.2.1:1234 "GET /timed HTTP/1.1" 200 3 "" 1.5s`},
+		{"7s", `2024/03/01 12:00:07 example.com 192.0.2.1:1234 "GET /timed HTTP/1.1" 200 3 "" 7s`},
+		{"1h", `2024/03/01 12:00:10 example.com 192.0.2.1:1234 "GET /timed HTTP/1.1" 200 3 "" 10s`}, // capped
+	}
+	for _, tc := range cases {
+		c := newFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		var out bytes.Buffer
+		l := &accessLogger{out: &out, clock: c, utc: true, timeFormat: httpLogDateFormat}
+		h := httpLog(l, withDelayHeader(c, 10*time.Second, func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hi\n")
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/timed", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Echo-Delay", tc.delay)
+		h(httptest.NewRecorder(), req)
+
+		if got := out.String(); got != tc.want+"\n" {
+			t.Errorf("X-Echo-Delay %q logged\n%q\nwant\n%q", tc.delay, got, tc.want+"\n")
+		}
+	}
+}
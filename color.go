@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// isTerminal reports whether w is a character device such as a TTY.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// colorStatus is a status code that formats itself wrapped in an ANSI color
+// escape for its class: green for 2xx, yellow for 4xx and red for 5xx.
+type colorStatus int
+
+// Format implements the fmt.Formatter interface.
+func (s colorStatus) Format(f fmt.State, verb rune) {
+	var code string
+	switch {
+	case s >= 500:
+		code = "31"
+	case s >= 400:
+		code = "33"
+	case s >= 200 && s < 300:
+		code = "32"
+	default:
+		fmt.Fprintf(f, "%d", int(s))
+		return
+	}
+	fmt.Fprintf(f, "\x1b[%sm%d\x1b[0m", code, int(s))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestColorStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		want   string
+	}{
+		{200, "\x1b[32m200\x1b[0m"},
+		{204, "\x1b[32m204\x1b[0m"},
+		{302, "302"},
+		{404, "\x1b[33m404\x1b[0m"},
+		{503, "\x1b[31m503\x1b[0m"},
+	}
+	for _, tc := range cases {
+		if got := fmt.Sprintf("%d", colorStatus(tc.status)); got != tc.want {
+			t.Errorf("colorStatus(%d) = %q, want %q", tc.status, got, tc.want)
+		}
+	}
+}
+
+func TestColorFlag(t *testing.T) {
+	cases := []struct {
+		color string
+		ansi  bool
+	}{
+		{"always", true},
+		{"never", false},
+		// The access log is a file rather than a terminal.
+		{"auto", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.color, func(t *testing.T) {
+			s := startServer(t, "-text", "hi", "-color", tc.color, "-status", "503")
+			if resp, _ := s.get(t, "/"); resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503", resp.StatusCode)
+			}
+			s.stop(t)
+
+			line := s.accessLogLines(t)[0]
+			if got := strings.Contains(line, "\x1b["); got != tc.ansi {
+				t.Errorf("-color %s: log line %q has ANSI codes: %t, want %t", tc.color, line, got, tc.ansi)
+			}
+			if tc.ansi && !strings.Contains(line, "\x1b[31m503\x1b[0m") {
+				t.Errorf("-color %s: log line %q does not have the status in red", tc.color, line)
+			}
+		})
+	}
+}
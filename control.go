@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeSettings are the echo behaviors that can be changed while the server
+// runs, through the -control-socket. Each is updated atomically, so requests
+// see either the old value or the new one.
+type runtimeSettings struct {
+	delay       atomic.Int64  // time.Duration
+	errorRate   atomic.Uint64 // math.Float64bits of a fraction in [0, 1]
+	maintenance atomic.Bool
+}
+
+// runtimeSettingNames lists the settings in the order "get" reports them.
+var runtimeSettingNames = []string{"delay", "error-rate", "maintenance"}
+
+// get returns the current value of the named setting.
+func (s *runtimeSettings) get(name string) (string, error) {
+	switch name {
+	case "delay":
+		return time.Duration(s.delay.Load()).String(), nil
+	case "error-rate":
+		return strconv.FormatFloat(math.Float64frombits(s.errorRate.Load()), 'g', -1, 64), nil
+	case "maintenance":
+		if s.maintenance.Load() {
+			return "on", nil
+		}
+		return "off", nil
+	default:
+		return "", fmt.Errorf("unknown setting %q", name)
+	}
+}
+
+// set parses value and stores it in the named setting.
+func (s *runtimeSettings) set(name, value string) error {
+	switch name {
+	case "delay":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("delay must be a non-negative duration")
+		}
+		s.delay.Store(int64(d))
+	case "error-rate":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("error-rate must be between 0 and 1")
+		}
+		s.errorRate.Store(math.Float64bits(f))
+	case "maintenance":
+		switch value {
+		case "on":
+			s.maintenance.Store(true)
+		case "off":
+			s.maintenance.Store(false)
+		default:
+			return fmt.Errorf("maintenance must be on or off")
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	return nil
+}
+
+// withRuntimeSettings applies s to each request: maintenance mode responds
+// 503, the delay is waited out, then the error rate picks requests to fail
+// with a 500.
+func withRuntimeSettings(s *runtimeSettings, c clock, rng *rand.Rand, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.maintenance.Load() {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if d := time.Duration(s.delay.Load()); d > 0 {
+			select {
+			case <-c.After(d):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rate := math.Float64frombits(s.errorRate.Load()); rate > 0 && rng.Float64() < rate {
+			http.Error(w, "simulated error from error-rate", http.StatusInternalServerError)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// serveControl accepts connections on ln and runs their commands against s
+// until ln is closed. Each line is one command, answered with one or more
+// lines:
+//
+//	get                 list every setting as "name value"
+//	get <name>          report one setting as "name value"
+//	set <name> <value>  change a setting, answering "ok"
+//
+// Failures are answered with "error: " and the reason.
+func serveControl(ln net.Listener, s *runtimeSettings) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handleControl(conn, s)
+	}
+}
+
+// handleControl runs the commands sent on conn until it is closed.
+func handleControl(conn net.Conn, s *runtimeSettings) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var reply []string
+		switch {
+		case fields[0] == "get" && len(fields) == 1:
+			for _, name := range runtimeSettingNames {
+				v, _ := s.get(name)
+				reply = append(reply, name+" "+v)
+			}
+		case fields[0] == "get" && len(fields) == 2:
+			v, err := s.get(fields[1])
+			if err != nil {
+				reply = append(reply, "error: "+err.Error())
+				break
+			}
+			reply = append(reply, fields[1]+" "+v)
+		case fields[0] == "set" && len(fields) == 3:
+			if err := s.set(fields[1], fields[2]); err != nil {
+				reply = append(reply, "error: "+err.Error())
+				break
+			}
+			log.Printf("[INFO] control socket set %s to %s", fields[1], fields[2])
+			reply = append(reply, "ok")
+		default:
+			reply = append(reply, "error: unknown command, expected get [name] or set <name> <value>")
+		}
+
+		if _, err := fmt.Fprintln(conn, strings.Join(reply, "\n")); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlSocket(t *testing.T) {
+	captureLog(t)
+	// serveControl takes any listener; main gives it a unix socket.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	settings := &runtimeSettings{}
+	go serveControl(ln, settings)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	send := func(cmd string, lines int) []string {
+		t.Helper()
+		fmt.Fprintln(conn, cmd)
+		var reply []string
+		for i := 0; i < lines; i++ {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading the reply to %q: %s", cmd, err)
+			}
+			reply = append(reply, line[:len(line)-1])
+		}
+		return reply
+	}
+
+	c := newFakeClock(time.Unix(0, 0))
+	h := withRuntimeSettings(settings, c, newRand(1), func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hi")
+	})
+	serve := func() (*httptest.ResponseRecorder, time.Duration) {
+		before := c.Now()
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec, c.Now().Sub(before)
+	}
+
+	if _, waited := serve(); waited != 0 {
+		t.Errorf("delayed %s before any set, want none", waited)
+	}
+
+	if reply := send("set delay 250ms", 1); reply[0] != "ok" {
+		t.Fatalf("set delay replied %q", reply)
+	}
+	if reply := send("get delay", 1); reply[0] != "delay 250ms" {
+		t.Errorf("get delay replied %q", reply)
+	}
+	for i := 0; i < 2; i++ {
+		if rec, waited := serve(); waited != 250*time.Millisecond || rec.Body.String() != "hi" {
+			t.Errorf("request %d after set delay: waited %s, body %q", i+1, waited, rec.Body.String())
+		}
+	}
+
+	if reply := send("set maintenance on", 1); reply[0] != "ok" {
+		t.Fatalf("set maintenance replied %q", reply)
+	}
+	if rec, _ := serve(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status in maintenance = %d, want 503", rec.Code)
+	}
+
+	reply := send("get", len(runtimeSettingNames))
+	want := []string{"delay 250ms", "error-rate 0", "maintenance on"}
+	for i := range want {
+		if reply[i] != want[i] {
+			t.Errorf("get line %d = %q, want %q", i+1, reply[i], want[i])
+		}
+	}
+
+	for _, cmd := range []string{"set delay -1s", "set error-rate 2", "get volume", "reboot"} {
+		if reply := send(cmd, 1); !strings.HasPrefix(reply[0], "error: ") {
+			t.Errorf("%q replied %q, want an error", cmd, reply)
+		}
+	}
+}
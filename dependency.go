@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// dependencyTimeout bounds each probe of a dependency.
+	dependencyTimeout = 2 * time.Second
+
+	// dependencyCacheTTL is how long a probe result is reused, so frequent
+	// readiness checks don't hammer the dependency.
+	dependencyCacheTTL = 5 * time.Second
+)
+
+// dependencyCheck probes an upstream URL and caches the result.
+type dependencyCheck struct {
+	url    string
+	client *http.Client
+	clock  clock
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+	pending   *dependencyProbe // probe in progress, if any
+}
+
+// dependencyProbe is one probe of a dependency, shared by every check made
+// while it runs. err is set before done is closed.
+type dependencyProbe struct {
+	done chan struct{}
+	err  error
+}
+
+func newDependencyCheck(c clock, url string) *dependencyCheck {
+	return &dependencyCheck{
+		url:    url,
+		client: &http.Client{Timeout: dependencyTimeout},
+		clock:  c,
+	}
+}
+
+// check returns nil if the dependency responded with a non-error status the
+// last time it was probed, probing again if the cached result has expired.
+// The probe runs detached from ctx, which only bounds how long check waits
+// for it, so one caller giving up doesn't fail the probe for the others.
+func (d *dependencyCheck) check(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.checkedAt.IsZero() && d.clock.Now().Sub(d.checkedAt) < dependencyCacheTTL {
+		err := d.err
+		d.mu.Unlock()
+		return err
+	}
+	p := d.pending
+	if p == nil {
+		p = &dependencyProbe{done: make(chan struct{})}
+		d.pending = p
+		go d.run(p)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run probes the dependency for p and caches the result. A canceled probe
+// says nothing about the dependency, so it isn't cached.
+func (d *dependencyCheck) run(p *dependencyProbe) {
+	ctx, cancel := context.WithTimeout(context.Background(), dependencyTimeout)
+	defer cancel()
+	p.err = d.probe(ctx)
+
+	d.mu.Lock()
+	d.pending = nil
+	if !errors.Is(p.err, context.Canceled) {
+		d.err = p.err
+		d.checkedAt = d.clock.Now()
+	}
+	d.mu.Unlock()
+	close(p.done)
+}
+
+func (d *dependencyCheck) probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkDependencies checks deps concurrently under a shared timeout. It
+// returns each dependency's status, "ok" or the error, keyed by URL, and
+// whether all of them are available.
+func checkDependencies(ctx context.Context, deps []*dependencyCheck) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, dependencyTimeout)
+	defer cancel()
+
+	errs := make([]error, len(deps))
+	var wg sync.WaitGroup
+	for i, d := range deps {
+		wg.Add(1)
+		go func(i int, d *dependencyCheck) {
+			defer wg.Done()
+			errs[i] = d.check(ctx)
+		}(i, d)
+	}
+	wg.Wait()
+
+	statuses := make(map[string]string, len(deps))
+	ok := true
+	for i, d := range deps {
+		if errs[i] != nil {
+			statuses[d.url] = errs[i].Error()
+			ok = false
+			continue
+		}
+		statuses[d.url] = "ok"
+	}
+	return statuses, ok
+}
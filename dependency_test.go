@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDependencyReadiness(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	logs := captureLog(t)
+
+	cases := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"up", up.URL, http.StatusOK},
+		{"error status", failing.URL, http.StatusServiceUnavailable},
+		{"unreachable", down.URL, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newFakeClock(time.Now())
+			rd := &readiness{deps: []*dependencyCheck{newDependencyCheck(c, tc.url)}}
+			rec := httptest.NewRecorder()
+			httpReady(rd, c, false)(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+			if rec.Code != tc.status {
+				t.Errorf("/ready = %d, want %d: %s", rec.Code, tc.status, rec.Body)
+			}
+			if logged := strings.Contains(logs.String(), "dependency "+tc.url+" is unavailable"); logged != (tc.status != http.StatusOK) {
+				t.Errorf("unavailable dependency logged = %t, want %t", logged, !logged)
+			}
+		})
+	}
+}
+
+func TestDependencyCheckCaches(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+
+	c := newFakeClock(time.Now())
+	d := newDependencyCheck(c, upstream.URL)
+	if err := d.check(context.Background()); err != nil {
+		t.Fatalf("first check: %s", err)
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	if err := d.check(context.Background()); err != nil {
+		t.Errorf("check within the cache TTL = %s, want the cached success", err)
+	}
+	c.Advance(dependencyCacheTTL)
+	if err := d.check(context.Background()); err == nil {
+		t.Error("check after the cache TTL succeeded, want the upstream's failure")
+	}
+}
+
+func TestDependencyAggregate(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	captureLog(t)
+	c := newFakeClock(time.Now())
+	rd := &readiness{deps: []*dependencyCheck{newDependencyCheck(c, up.URL), newDependencyCheck(c, down.URL)}}
+	rec := httptest.NewRecorder()
+	httpReady(rd, c, false)(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready = %d, want 503", rec.Code)
+	}
+	var body struct {
+		Status       string            `json:"status"`
+		Dependencies map[string]string `json:"dependencies"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding /ready: %s\n%s", err, rec.Body)
+	}
+	if body.Status != "dependency unavailable" {
+		t.Errorf("status = %q, want dependency unavailable", body.Status)
+	}
+	if got := body.Dependencies[up.URL]; got != "ok" {
+		t.Errorf("%s status = %q, want ok", up.URL, got)
+	}
+	if got := body.Dependencies[down.URL]; got == "" || got == "ok" {
+		t.Errorf("%s status = %q, want its error", down.URL, got)
+	}
+}
+
+func TestDependencyCheckDetachedProbe(t *testing.T) {
+	var probes atomic.Int64
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	d := newDependencyCheck(newFakeClock(time.Now()), upstream.URL)
+
+	// A caller that gives up gets its own error back without waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.check(ctx); err != context.Canceled {
+		t.Fatalf("check with a canceled context = %v, want context.Canceled", err)
+	}
+
+	// Other callers share the probe it started, which is unaffected.
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errCh <- d.check(context.Background()) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Errorf("check after another caller gave up = %s, want the probe's success", err)
+		}
+	}
+	if n := probes.Load(); n != 1 {
+		t.Errorf("dependency probed %d times, want once", n)
+	}
+	if err := d.check(context.Background()); err != nil {
+		t.Errorf("cached check = %s, want success", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// shellArgs returns the argv that runs command through the shell, so quoting,
+// pipes and redirects work as they would on the command line.
+func shellArgs(command string) []string {
+	return []string{"/bin/sh", "-c", command}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "strings"
+
+// stringSliceFlag is a flag.Value that collects every occurrence of a
+// repeatable flag.
+type stringSliceFlag []string
+
+// String implements the flag.Value interface.
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+// Set implements the flag.Value interface.
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
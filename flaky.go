@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// flakyTTL is how long /flaky remembers a key after its last request.
+const flakyTTL = 5 * time.Minute
+
+// flakyTracker counts requests to /flaky per key, forgetting keys that have
+// not been seen for ttl.
+type flakyTracker struct {
+	clock clock
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*flakyEntry
+}
+
+// flakyEntry is the request count of one /flaky key.
+type flakyEntry struct {
+	count    int
+	lastSeen time.Time
+}
+
+func newFlakyTracker(c clock, ttl time.Duration) *flakyTracker {
+	return &flakyTracker{
+		clock:   c,
+		ttl:     ttl,
+		entries: make(map[string]*flakyEntry),
+	}
+}
+
+// hit records a request for key and returns how many requests it has seen,
+// including this one.
+func (t *flakyTracker) hit(key string) int {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, e := range t.entries {
+		if now.Sub(e.lastSeen) > t.ttl {
+			delete(t.entries, k)
+		}
+	}
+
+	e, ok := t.entries[key]
+	if !ok {
+		e = &flakyEntry{}
+		t.entries[key] = e
+	}
+	e.count++
+	e.lastSeen = now
+	return e.count
+}
+
+// httpFlaky responds 503 to the first failures requests for each value of the
+// X-Flaky-Key header and 200 after that, to exercise client retries. The
+// failures query parameter overrides the default count.
+func httpFlaky(t *flakyTracker, failures int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := failures
+		if v := r.URL.Query().Get("failures"); v != "" {
+			f, err := strconv.Atoi(v)
+			if err != nil || f < 0 {
+				http.Error(w, "invalid failures", http.StatusBadRequest)
+				return
+			}
+			n = f
+		}
+
+		attempt := t.hit(r.Header.Get("X-Flaky-Key"))
+		w.Header().Set("X-Flaky-Attempt", strconv.Itoa(attempt))
+		if attempt <= n {
+			http.Error(w, fmt.Sprintf("failing attempt %d of %d", attempt, n), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "succeeded on attempt %d\n", attempt)
+	}
+}
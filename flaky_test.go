@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFlaky(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	h := httpFlaky(newFlakyTracker(c, time.Minute), 3)
+	do := func(key, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Flaky-Key", key)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	// The first three attempts fail and the fourth succeeds.
+	for attempt := 1; attempt <= 4; attempt++ {
+		want := http.StatusServiceUnavailable
+		if attempt == 4 {
+			want = http.StatusOK
+		}
+		rec := do("a", "/flaky")
+		if rec.Code != want {
+			t.Errorf("attempt %d = %d, want %d", attempt, rec.Code, want)
+		}
+		if got := rec.Header().Get("X-Flaky-Attempt"); got != strconv.Itoa(attempt) {
+			t.Errorf("attempt %d: X-Flaky-Attempt = %q", attempt, got)
+		}
+	}
+	if rec := do("a", "/flaky"); rec.Code != http.StatusOK || rec.Body.String() != "succeeded on attempt 5\n" {
+		t.Errorf("attempt 5 = %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Keys are counted separately, and the query overrides the count.
+	if rec := do("b", "/flaky?failures=0"); rec.Code != http.StatusOK {
+		t.Errorf("first attempt with failures=0 = %d, want 200", rec.Code)
+	}
+	if rec := do("c", "/flaky?failures=x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("failures=x = %d, want 400", rec.Code)
+	}
+
+	// A key that goes quiet for longer than the TTL starts over.
+	c.Advance(2 * time.Minute)
+	if rec := do("a", "/flaky"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("X-Flaky-Attempt") != "1" {
+		t.Errorf("attempt after the TTL = %d, attempt %s; want 503, attempt 1", rec.Code, rec.Header().Get("X-Flaky-Attempt"))
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// validGzipLevel reports whether level can be used with -gzip-level.
+func validGzipLevel(level int) bool {
+	return level == gzip.DefaultCompression || (level >= gzip.BestSpeed && level <= gzip.BestCompression)
+}
+
+// httpDecode echoes the request body back, decompressing it first when it is
+// sent with Content-Encoding: gzip. Bodies that decompress to more than max
+// bytes get a 413 rather than being read into memory in full.
+func httpDecode(max int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		switch coding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); coding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid gzip body: %s", err), http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			body = zr
+		default:
+			http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q", coding), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		r.Body = io.NopCloser(io.LimitReader(body, max+1))
+		b, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		if int64(len(b)) > max {
+			http.Error(w, fmt.Sprintf("decoded body exceeds maximum of %d bytes", max), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Write(b)
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		return strings.ReplaceAll(params, " ", "") != "q=0"
+	}
+	return false
+}
+
+// withGzip compresses responses at the given level for clients that accept
+// gzip. Responses whose body is no larger than minSize bytes are sent
+// uncompressed.
+func withGzip(level, minSize int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, level: level, minSize: minSize}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter compresses everything written to it. Responses that
+// cannot carry a body are passed through untouched.
+//
+// When minSize is positive the status is held back and the body buffered
+// until it grows past minSize, at which point compression starts. Bodies that
+// are finished or flushed before then go out as they are.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level   int
+	minSize int
+
+	gz          *gzip.Writer
+	wroteHeader bool
+
+	// pending is set while the status is held back in status and the body
+	// in buf.
+	pending bool
+	status  int
+	buf     []byte
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *gzipResponseWriter) WriteHeader(s int) {
+	if s < http.StatusOK {
+		// Informational responses precede the real one.
+		w.ResponseWriter.WriteHeader(s)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if s == http.StatusNoContent || s == http.StatusNotModified || w.Header().Get("Content-Encoding") != "" {
+		w.ResponseWriter.WriteHeader(s)
+		return
+	}
+	if w.minSize > 0 {
+		n, err := strconv.Atoi(w.Header().Get("Content-Length"))
+		if err != nil {
+			// The size is unknown until the body has been written.
+			w.pending = true
+			w.status = s
+			return
+		}
+		if n <= w.minSize {
+			w.ResponseWriter.WriteHeader(s)
+			return
+		}
+	}
+	w.startGzip()
+	w.ResponseWriter.WriteHeader(s)
+}
+
+// startGzip marks the response as compressed and directs the body through a
+// gzip stream.
+func (w *gzipResponseWriter) startGzip() {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", "gzip")
+	// The error is only non-nil for invalid levels, which are rejected at
+	// startup.
+	w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, w.level)
+}
+
+// release sends the held-back status and buffered body, compressing them if
+// gz is true.
+func (w *gzipResponseWriter) release(gz bool) error {
+	w.pending = false
+	if gz {
+		w.startGzip()
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.pending {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) <= w.minSize {
+			return len(b), nil
+		}
+		if err := w.release(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush implements the http.Flusher interface, flushing compressed data
+// through to the client.
+func (w *gzipResponseWriter) Flush() {
+	if w.pending {
+		w.release(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface when the underlying writer
+// supports it. Nothing is compressed once the connection is taken over.
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.pending = false
+	return hj.Hijack()
+}
+
+// Close finishes the gzip stream, if one was started, or sends a body that
+// stayed under the minimum size uncompressed.
+func (w *gzipResponseWriter) Close() error {
+	if w.pending {
+		return w.release(false)
+	}
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
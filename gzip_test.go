@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipPayload is compressible text varied enough that compression levels
+// make a difference.
+func gzipPayload() string {
+	words := []string{"echo", "http", "server", "request", "response", "header", "body", "gzip", "level", "test"}
+	rng := newRand(1)
+	var b strings.Builder
+	for b.Len() < 64<<10 {
+		b.WriteString(words[rng.Intn(len(words))])
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// gzipGet serves a GET through withGzip and returns the recorded response.
+func gzipGet(level, minSize int, body string) *httptest.ResponseRecorder {
+	h := withGzip(level, minSize, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGzipLevel(t *testing.T) {
+	payload := gzipPayload()
+
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		rec := gzipGet(level, 0, payload)
+		if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("level %d: Content-Encoding = %q, want gzip", level, got)
+		}
+		sizes[level] = rec.Body.Len()
+
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != payload {
+			t.Errorf("level %d: body does not decompress to the payload", level)
+		}
+	}
+
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("level 9 body is %d bytes, want it smaller than level 1's %d", sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+
+	for level, want := range map[int]bool{-1: true, 1: true, 9: true, 0: false, 10: false, -2: false} {
+		if got := validGzipLevel(level); got != want {
+			t.Errorf("validGzipLevel(%d) = %t, want %t", level, got, want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	compress := func(s string) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		io.WriteString(zw, s)
+		zw.Close()
+		return b.Bytes()
+	}
+
+	cases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		want     string
+	}{
+		{"gzip", "gzip", compress("hello, decoded"), http.StatusOK, "hello, decoded"},
+		{"identity", "", []byte("plain"), http.StatusOK, "plain"},
+		{"at the limit", "gzip", compress(strings.Repeat("a", 1024)), http.StatusOK, strings.Repeat("a", 1024)},
+		// A small compressed body that expands past the limit.
+		{"oversized", "gzip", compress(strings.Repeat("a", 1025)), http.StatusRequestEntityTooLarge, ""},
+		{"corrupt", "gzip", []byte("not gzip"), http.StatusBadRequest, ""},
+		{"unsupported", "br", []byte("x"), http.StatusUnsupportedMediaType, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/decode", bytes.NewReader(tc.body))
+			req.Header.Set("Content-Encoding", tc.encoding)
+			req.Header.Set("Content-Type", "text/plain")
+			rec := httptest.NewRecorder()
+			httpDecode(1024)(rec, req)
+
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.status, rec.Body)
+			}
+			if tc.status == http.StatusOK && rec.Body.String() != tc.want {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestGzipMinSize(t *testing.T) {
+	small := strings.Repeat("s", 100)
+	large := strings.Repeat("l", 1000)
+
+	for _, tc := range []struct {
+		body       string
+		compressed bool
+	}{
+		{small, false},
+		{strings.Repeat("e", 512), false},
+		{large, true},
+	} {
+		rec := gzipGet(gzip.DefaultCompression, 512, tc.body)
+		if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tc.compressed {
+			t.Errorf("%d byte body: compressed = %t, want %t", len(tc.body), got, tc.compressed)
+		}
+
+		body := rec.Body.String()
+		if tc.compressed {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(zr)
+			body = string(b)
+		}
+		if body != tc.body {
+			t.Errorf("%d byte body came back as %d bytes", len(tc.body), len(body))
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerValueReplacer strips line breaks from header values written by
+// withHeaderOrder, as net/http does for regular responses.
+var headerValueReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// parseHeaderOrder splits a comma-separated list of header names into their
+// canonical forms.
+func parseHeaderOrder(s string) ([]string, error) {
+	var order []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		order = append(order, textproto.CanonicalMIMEHeaderKey(name))
+	}
+	return order, nil
+}
+
+// bufferedResponseWriter captures a complete response in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header implements the http.ResponseWriter interface.
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	// Informational responses can't be replayed after the fact, so only the
+	// final status is kept.
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// writeTo sends the buffered response through w as an ordinary response,
+// replacing any headers already set on it.
+func (w *bufferedResponseWriter) writeTo(dst http.ResponseWriter) {
+	hdr := dst.Header()
+	for name := range hdr {
+		delete(hdr, name)
+	}
+	for name, values := range w.header {
+		hdr[name] = values
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	dst.WriteHeader(w.status)
+	dst.Write(w.body.Bytes())
+}
+
+// headerOrderMaxDrain is how much of an unread request body withHeaderOrder
+// reads past to keep the connection alive, as net/http does. Connections with
+// more left are closed instead.
+const headerOrderMaxDrain = 256 << 10
+
+// withHeaderOrder writes responses from h with the headers in order first, and
+// any others after them alphabetically, which net/http itself can't do. The
+// response is buffered and written to the hijacked connection with the
+// request's protocol version. A hijacked connection can't be handed back to
+// net/http, so when the request allows it withHeaderOrder keeps the
+// connection alive and serves the requests that follow on it itself, until
+// the client closes it, it sits idle for the server's idle timeout, or
+// shutdownCh is closed. Responses to requests that streaming reports are
+// written as they are produced, and all others are buffered, so main also
+// keeps the streaming endpoints out of it with withStreamingBypass.
+// Connections that can't be hijacked, such as HTTP/2 ones or those behind a
+// writer without Hijack support, are served as usual without reordering.
+func withHeaderOrder(c clock, order []string, shutdownCh <-chan struct{}, streaming func(*http.Request) bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		brw := &bufferedResponseWriter{header: make(http.Header)}
+		h.ServeHTTP(brw, r)
+		// The body can't be read once the connection is hijacked, and what
+		// is left of it would be taken for the next request.
+		drained := drainBody(r.Body)
+
+		conn, bufrw, err := hj.Hijack()
+		if err == http.ErrNotSupported {
+			brw.writeTo(w)
+			return
+		}
+		if err != nil {
+			log.Printf("[ERR] failed to hijack connection for ordered headers: %s", err)
+			return
+		}
+
+		oc := &orderedConn{
+			clock:      c,
+			order:      order,
+			conn:       conn,
+			bufrw:      bufrw,
+			ctx:        r.Context(),
+			shutdownCh: shutdownCh,
+		}
+		if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+			oc.idleTimeout = srv.IdleTimeout
+			if oc.idleTimeout == 0 {
+				oc.idleTimeout = srv.ReadTimeout
+			}
+		}
+		oc.serve(r, brw, drained, streaming, h)
+	})
+}
+
+// drainBody reads what is left of body and reports whether it reached the end
+// within headerOrderMaxDrain bytes.
+func drainBody(body io.Reader) bool {
+	if body == nil {
+		return true
+	}
+	n, err := io.CopyN(io.Discard, body, headerOrderMaxDrain+1)
+	return err == io.EOF && n <= headerOrderMaxDrain
+}
+
+// orderedConn is a connection hijacked by withHeaderOrder.
+type orderedConn struct {
+	clock       clock
+	order       []string
+	conn        net.Conn
+	bufrw       *bufio.ReadWriter
+	ctx         context.Context
+	idleTimeout time.Duration
+	shutdownCh  <-chan struct{}
+
+	mu      sync.Mutex
+	idle    bool // waiting for the next request
+	closing bool // shutdownCh was closed
+}
+
+// serve writes the response to r and then serves further requests on the
+// connection for as long as it is kept alive, closing it at the end.
+func (oc *orderedConn) serve(r *http.Request, brw *bufferedResponseWriter, drained bool, streaming func(*http.Request) bool, h http.Handler) {
+	defer oc.conn.Close()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go oc.watchShutdown(stopCh)
+
+	keepAlive := oc.writeBuffered(r, brw, drained)
+	for keepAlive {
+		next, ok := oc.readRequest(r)
+		if !ok {
+			return
+		}
+		if streaming != nil && streaming(next) {
+			sw := &rawStreamWriter{oc: oc, r: next, header: make(http.Header)}
+			h.ServeHTTP(sw, next)
+			keepAlive = sw.finish()
+			continue
+		}
+		brw = &bufferedResponseWriter{header: make(http.Header)}
+		h.ServeHTTP(brw, next)
+		keepAlive = oc.writeBuffered(next, brw, drainBody(next.Body))
+	}
+}
+
+// watchShutdown stops the connection waiting for another request once
+// shutdownCh is closed, until stopCh is.
+func (oc *orderedConn) watchShutdown(stopCh <-chan struct{}) {
+	select {
+	case <-oc.shutdownCh:
+	case <-stopCh:
+		return
+	}
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	oc.closing = true
+	if oc.idle {
+		// Any deadline in the past unblocks the read.
+		oc.conn.SetReadDeadline(time.Unix(1, 0))
+	}
+}
+
+// readRequest reads the next request on the connection. It takes what the
+// connection can't convey, such as the context and remote address, from
+// first, the request the connection was hijacked for.
+func (oc *orderedConn) readRequest(first *http.Request) (*http.Request, bool) {
+	oc.mu.Lock()
+	if oc.closing {
+		oc.mu.Unlock()
+		return nil, false
+	}
+	oc.idle = true
+	if oc.idleTimeout > 0 {
+		oc.conn.SetReadDeadline(time.Now().Add(oc.idleTimeout))
+	}
+	oc.mu.Unlock()
+
+	r, err := http.ReadRequest(oc.bufrw.Reader)
+
+	oc.mu.Lock()
+	oc.idle = false
+	oc.conn.SetReadDeadline(time.Time{})
+	oc.mu.Unlock()
+	if err != nil {
+		return nil, false
+	}
+
+	r.RemoteAddr = first.RemoteAddr
+	r.TLS = first.TLS
+	if r.ProtoAtLeast(1, 1) && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		oc.bufrw.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+		if err := oc.bufrw.Flush(); err != nil {
+			return nil, false
+		}
+	}
+	return r.WithContext(oc.ctx), true
+}
+
+// keepAlive reports whether the connection can take another request after
+// the response to r with hdr.
+func (oc *orderedConn) keepAlive(r *http.Request, hdr http.Header) bool {
+	if r.Close || hasToken(hdr["Connection"], "close") {
+		return false
+	}
+	select {
+	case <-oc.shutdownCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// writeBuffered writes brw as the response to r, and reports whether the
+// connection is to be kept alive. drained reports whether r's body was read
+// in full.
+func (oc *orderedConn) writeBuffered(r *http.Request, brw *bufferedResponseWriter, drained bool) bool {
+	if brw.status == 0 {
+		brw.status = http.StatusOK
+	}
+	hdr := brw.header
+	hdr.Del("Transfer-Encoding")
+	if bodyAllowed(brw.status) {
+		hdr.Set("Content-Length", strconv.Itoa(brw.body.Len()))
+	}
+	keepAlive := drained && oc.keepAlive(r, hdr)
+
+	oc.writeHeader(r, brw.status, hdr, keepAlive)
+	if r.Method != http.MethodHead {
+		oc.bufrw.Write(brw.body.Bytes())
+	}
+	if err := oc.bufrw.Flush(); err != nil {
+		log.Printf("[ERR] failed to write response with ordered headers: %s", err)
+		return false
+	}
+	return keepAlive
+}
+
+// writeHeader writes the status line and hdr, in order, for the response to r.
+func (oc *orderedConn) writeHeader(r *http.Request, status int, hdr http.Header, keepAlive bool) {
+	switch {
+	case !keepAlive:
+		hdr.Set("Connection", "close")
+	case !r.ProtoAtLeast(1, 1):
+		hdr.Set("Connection", "keep-alive")
+	default:
+		hdr.Del("Connection")
+	}
+	if _, ok := hdr["Date"]; !ok {
+		hdr.Set("Date", oc.clock.Now().UTC().Format(http.TimeFormat))
+	}
+
+	seen := make(map[string]bool, len(oc.order))
+	names := make([]string, 0, len(hdr))
+	for _, name := range oc.order {
+		if _, ok := hdr[name]; ok && !seen[name] {
+			names = append(names, name)
+		}
+		seen[name] = true
+	}
+	var rest []string
+	for name := range hdr {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	fmt.Fprintf(oc.bufrw, "HTTP/%d.%d %d %s\r\n", r.ProtoMajor, r.ProtoMinor, status, http.StatusText(status))
+	for _, name := range names {
+		for _, v := range hdr[name] {
+			fmt.Fprintf(oc.bufrw, "%s: %s\r\n", name, headerValueReplacer.Replace(v))
+		}
+	}
+	oc.bufrw.WriteString("\r\n")
+}
+
+// rawStreamWriter writes a response straight to an orderedConn as it is
+// produced, chunked unless the handler sets a Content-Length.
+type rawStreamWriter struct {
+	oc     *orderedConn
+	r      *http.Request
+	header http.Header
+
+	wroteHeader bool
+	keepAlive   bool
+	noBody      bool
+	chunked     io.WriteCloser
+	hijacked    bool
+	err         error
+}
+
+// Header implements the http.ResponseWriter interface.
+func (w *rawStreamWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *rawStreamWriter) WriteHeader(status int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	if status < http.StatusOK {
+		fmt.Fprintf(w.oc.bufrw, "HTTP/%d.%d %d %s\r\n\r\n", w.r.ProtoMajor, w.r.ProtoMinor, status, http.StatusText(status))
+		w.oc.bufrw.Flush()
+		return
+	}
+	w.wroteHeader = true
+
+	hdr := w.header
+	w.noBody = !bodyAllowed(status) || w.r.Method == http.MethodHead
+	_, sized := hdr["Content-Length"]
+	w.keepAlive = w.oc.keepAlive(w.r, hdr)
+	switch {
+	case w.noBody || sized:
+		hdr.Del("Transfer-Encoding")
+	case w.r.ProtoAtLeast(1, 1):
+		hdr.Set("Transfer-Encoding", "chunked")
+		w.chunked = httputil.NewChunkedWriter(w.oc.bufrw)
+	default:
+		// HTTP/1.0 clients read to the end of the connection instead.
+		w.keepAlive = false
+	}
+	w.oc.writeHeader(w.r, status, hdr, w.keepAlive)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *rawStreamWriter) Write(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	w.WriteHeader(http.StatusOK)
+	if w.noBody {
+		return 0, http.ErrBodyNotAllowed
+	}
+	var n int
+	if w.chunked != nil {
+		n, w.err = w.chunked.Write(b)
+	} else {
+		n, w.err = w.oc.bufrw.Write(b)
+	}
+	return n, w.err
+}
+
+// Flush implements the http.Flusher interface.
+func (w *rawStreamWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := w.oc.bufrw.Flush(); err != nil {
+		w.err = err
+	}
+}
+
+// Hijack implements the http.Hijacker interface. The connection is closed
+// once the handler returns.
+func (w *rawStreamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.hijacked = true
+	return w.oc.conn, w.oc.bufrw, nil
+}
+
+// finish ends the response and reports whether the connection is to be kept
+// alive.
+func (w *rawStreamWriter) finish() bool {
+	if w.hijacked {
+		return false
+	}
+	w.WriteHeader(http.StatusOK)
+	if w.chunked != nil {
+		w.chunked.Close()
+		w.oc.bufrw.WriteString("\r\n")
+	}
+	if err := w.oc.bufrw.Flush(); err != nil || w.err != nil {
+		return false
+	}
+	return w.keepAlive && drainBody(w.r.Body)
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// hasToken reports whether any of the comma-separated values holds token.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawHeaderNames sends a GET for path to addr and returns the status line and
+// the response header names in the order they arrived on the wire.
+func rawHeaderNames(t *testing.T, addr, path string) (string, []string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, addr)
+
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			return strings.TrimSpace(status), names
+		}
+		name, _, _ := strings.Cut(line, ":")
+		names = append(names, name)
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-response-header-order", "x-request-id, content-type")
+
+	status, names := rawHeaderNames(t, s.addr, "/")
+	if status != "HTTP/1.1 200 OK" {
+		t.Errorf("status line = %q", status)
+	}
+	want := []string{"X-Request-Id", "Content-Type", "Content-Length", "Date"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("header order = %v, want %v", names, want)
+	}
+
+	// Streaming endpoints bypass the buffering, so they aren't reordered or
+	// made to close the connection.
+	_, names = rawHeaderNames(t, s.addr, "/drip?numbytes=1&duration=0s")
+	for _, name := range names {
+		if name == "Connection" {
+			t.Errorf("/drip headers %v include Connection, want it served without reordering", names)
+		}
+	}
+	if names[0] == "X-Request-Id" {
+		t.Errorf("/drip headers %v start with X-Request-Id, want them in net/http's order", names)
+	}
+}
+
+func TestParseHeaderOrder(t *testing.T) {
+	order, err := parseHeaderOrder(" content-type,x-custom ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, ",") != "Content-Type,X-Custom" {
+		t.Errorf("parseHeaderOrder = %v, want canonical names", order)
+	}
+
+	for _, bad := range []string{"", "a,,b", "bad name", "colon:"} {
+		if _, err := parseHeaderOrder(bad); err == nil {
+			t.Errorf("parseHeaderOrder(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestHeaderOrderDate(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(withHeaderOrder(newFakeClock(now), []string{"Date"}, nil, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Header.Get("Date"), now.Format(http.TimeFormat); got != want {
+		t.Errorf("Date = %q, want %q from the clock", got, want)
+	}
+}
+
+func TestHeaderOrderKeepAlive(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-response-header-order", "x-request-id", "-allow-reset")
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", s.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	send := func(conn net.Conn, br *bufio.Reader, raw string) (*http.Response, string) {
+		t.Helper()
+		io.WriteString(conn, raw)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("reading the response to %q: %s", raw, err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading the body of the response to %q: %s", raw, err)
+		}
+		return resp, string(b)
+	}
+
+	conn, br := dial()
+	for _, tc := range []struct {
+		raw  string
+		body string
+	}{
+		{"GET / HTTP/1.1\r\nHost: echo\r\n\r\n", "hi\n"},
+		// A body the handler leaves unread is skipped.
+		{"POST / HTTP/1.1\r\nHost: echo\r\nContent-Length: 3\r\n\r\nabc", "hi\n"},
+		// Streaming endpoints are written as they go, chunked.
+		{"GET /drip?numbytes=3&duration=0s HTTP/1.1\r\nHost: echo\r\n\r\n", "***"},
+		{"GET / HTTP/1.1\r\nHost: echo\r\n\r\n", "hi\n"},
+	} {
+		resp, body := send(conn, br, tc.raw)
+		if resp.Proto != "HTTP/1.1" || resp.Close || body != tc.body {
+			t.Errorf("response to %q = %s, close %t, body %q; want HTTP/1.1 kept alive with %q", tc.raw, resp.Proto, resp.Close, body, tc.body)
+		}
+		if resp.Header.Get("X-Request-Id") == "" {
+			t.Errorf("response to %q has headers %v, want them from the echo handler", tc.raw, resp.Header)
+		}
+	}
+	if resp, _ := send(conn, br, "GET / HTTP/1.1\r\nHost: echo\r\nConnection: close\r\n\r\n"); !resp.Close {
+		t.Error("response to Connection: close kept the connection alive")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("reading after Connection: close = %v, want EOF", err)
+	}
+
+	// HTTP/1.0 gets an HTTP/1.0 response, kept alive only if asked and the
+	// handler allows it; the echo handler itself always closes.
+	conn, br = dial()
+	resp, _ := send(conn, br, "GET / HTTP/1.0\r\n\r\n")
+	if resp.Proto != "HTTP/1.0" || !resp.Close {
+		t.Errorf("HTTP/1.0 response = %s, close %t; want HTTP/1.0 closed", resp.Proto, resp.Close)
+	}
+	conn, br = dial()
+	for i := 0; i < 2; i++ {
+		resp, _ := send(conn, br, "GET /health HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+		if resp.Proto != "HTTP/1.0" || resp.Close || resp.Header.Get("Connection") != "keep-alive" || resp.StatusCode != http.StatusOK {
+			t.Errorf("HTTP/1.0 keep-alive response %d = %s %d, Connection %q", i+1, resp.Proto, resp.StatusCode, resp.Header.Get("Connection"))
+		}
+	}
+
+	// Endpoints that hijack the connection still get it.
+	conn, br = dial()
+	send(conn, br, "GET / HTTP/1.1\r\nHost: echo\r\n\r\n")
+	io.WriteString(conn, "GET /reset HTTP/1.1\r\nHost: echo\r\n\r\n")
+	if resp, err := http.ReadResponse(br, nil); err == nil {
+		t.Errorf("/reset on a kept-alive connection got a %d response, want the connection reset", resp.StatusCode)
+	}
+
+	// Shutting down closes idle connections.
+	conn, br = dial()
+	send(conn, br, "GET / HTTP/1.1\r\nHost: echo\r\n\r\n")
+	s.cancel()
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("reading from an idle connection after shutdown = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// runHeartbeat logs the number of echo requests served and the uptime every
+// interval until stopCh is closed, then closes doneCh.
+func runHeartbeat(interval time.Duration, startedAt time.Time, served *atomic.Uint64, stopCh <-chan struct{}, doneCh chan<- struct{}) {
+	defer close(doneCh)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-t.C:
+			log.Printf("[INFO] heartbeat: served %d requests, up %s", served.Load(), now.Sub(startedAt).Round(time.Second))
+		}
+	}
+}
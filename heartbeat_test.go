@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	logs := captureLog(t)
+
+	var served atomic.Uint64
+	served.Store(7)
+	stopCh, doneCh := make(chan struct{}), make(chan struct{})
+	go runHeartbeat(10*time.Millisecond, time.Now(), &served, stopCh, doneCh)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "heartbeat: served 7 requests, up ") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no heartbeat logged: %q", logs.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(stopCh)
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat goroutine did not exit after stop")
+	}
+}
+
+func TestHeartbeatStopsOnShutdown(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-heartbeat-interval", "10ms")
+	s.get(t, "/")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(s.logs.String(), "heartbeat: served 1 requests") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no heartbeat logged: %q", s.logs.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Shutdown waits for the heartbeat to stop, so none follow it.
+	s.stop(t)
+	n := strings.Count(s.logs.String(), "heartbeat:")
+	time.Sleep(50 * time.Millisecond)
+	if m := strings.Count(s.logs.String(), "heartbeat:"); m != n {
+		t.Errorf("%d heartbeats logged after shutdown", m-n)
+	}
+}
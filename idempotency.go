@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idempotencyMaxBody bounds the response body kept for replaying to a
+// duplicate request. Longer responses are not replayed.
+const idempotencyMaxBody = 64 << 10
+
+// idempotentResponse is what was seen for one Idempotency-Key.
+type idempotentResponse struct {
+	firstSeen time.Time
+	count     int
+
+	// done is set once the first response is complete and, unless
+	// truncated, can be replayed.
+	done      bool
+	truncated bool
+	status    int
+	header    http.Header
+	body      []byte
+}
+
+// idempotencyStore remembers Idempotency-Key values for ttl after they are
+// first seen, keeping at most max of them by dropping the oldest.
+type idempotencyStore struct {
+	clock clock
+	ttl   time.Duration
+	max   int
+
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	order   []string // keys in the order they were first seen
+}
+
+func newIdempotencyStore(c clock, ttl time.Duration, max int) *idempotencyStore {
+	return &idempotencyStore{
+		clock:   c,
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[string]*idempotentResponse),
+	}
+}
+
+// see records a request carrying key. It returns the entry for key, how many
+// times and how long ago it has been seen, and whether key had been seen
+// already within the TTL window. The count and age are read under s.mu, as the
+// entry may be updated concurrently.
+func (s *idempotencyStore) see(key string) (e *idempotentResponse, count int, age time.Duration, dup bool) {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keys are never refreshed, so the oldest are the first to expire.
+	for len(s.order) > 0 && now.Sub(s.entries[s.order[0]].firstSeen) > s.ttl {
+		s.dropOldest()
+	}
+
+	if e, ok := s.entries[key]; ok {
+		e.count++
+		return e, e.count, now.Sub(e.firstSeen), true
+	}
+	for len(s.order) >= s.max {
+		s.dropOldest()
+	}
+	e = &idempotentResponse{firstSeen: now, count: 1}
+	s.entries[key] = e
+	s.order = append(s.order, key)
+	return e, 1, 0, false
+}
+
+// dropOldest forgets the key that was seen first. s.mu must be held.
+func (s *idempotencyStore) dropOldest() {
+	delete(s.entries, s.order[0])
+	s.order = s.order[1:]
+}
+
+// finish stores the response to the first request for e.
+func (s *idempotencyStore) finish(e *idempotentResponse, status int, header http.Header, body []byte, truncated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.done = true
+	e.status, e.header, e.body, e.truncated = status, header, body, truncated
+}
+
+// replayable returns a copy of e's response if it can be replayed.
+func (s *idempotencyStore) replayable(e *idempotentResponse) (int, http.Header, []byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !e.done || e.truncated {
+		return 0, nil, nil, false
+	}
+	return e.status, e.header.Clone(), e.body, true
+}
+
+// idempotencyRecorder passes a response through while keeping a copy of it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if w.status == 0 && status >= http.StatusOK {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *idempotencyRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(b) > idempotencyMaxBody {
+		w.truncated = true
+	} else if !w.truncated {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements the http.Flusher interface.
+func (w *idempotencyRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withIdempotency logs requests whose Idempotency-Key was already seen within
+// the store's TTL. With replay set, duplicates get the first response again,
+// marked with Idempotent-Replayed, instead of reaching h, as long as that
+// response has completed and was small enough to keep.
+func withIdempotency(s *idempotencyStore, replay bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		e, count, age, dup := s.see(key)
+		if dup {
+			log.Printf("[WARN] duplicate Idempotency-Key %q on %s %s (seen %d times in %s)",
+				key, r.Method, r.URL.Path, count, age.Round(time.Millisecond))
+			if replay {
+				if status, header, body, ok := s.replayable(e); ok {
+					for k, v := range header {
+						// Headers already set for this request, such as its
+						// request ID, are kept.
+						if _, ok := w.Header()[k]; !ok {
+							w.Header()[k] = v
+						}
+					}
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(status)
+					w.Write(body)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.finish(e, rec.status, w.Header().Clone(), rec.body.Bytes(), rec.truncated)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	cases := []struct {
+		name   string
+		replay bool
+		// between, if set, runs between the two requests.
+		between func(c *fakeClock, h http.Handler)
+		dup     bool
+		body    string
+	}{
+		{"duplicate logged", false, nil, true, "call 2"},
+		{"duplicate replayed", true, nil, true, "call 1"},
+		{"expired", true, func(c *fakeClock, h http.Handler) { c.Advance(time.Minute + time.Second) }, false, "call 2"},
+		{"evicted", true, func(c *fakeClock, h http.Handler) {
+			for _, key := range []string{"b", "c"} {
+				req := httptest.NewRequest(http.MethodPost, "/", nil)
+				req.Header.Set("Idempotency-Key", key)
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}, false, "call 4"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLog(t)
+			c := newFakeClock(time.Unix(0, 0))
+			var calls int
+			h := withIdempotency(newIdempotencyStore(c, time.Minute, 2), tc.replay, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("X-Call", fmt.Sprint(calls))
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, "call %d", calls)
+			}))
+			send := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+				req.Header.Set("Idempotency-Key", " a ")
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				return rec
+			}
+
+			send()
+			if tc.between != nil {
+				tc.between(c, h)
+			}
+			c.Advance(time.Second)
+			rec := send()
+
+			if rec.Code != http.StatusCreated || rec.Body.String() != tc.body {
+				t.Errorf("second response = %d %q, want 201 %q", rec.Code, rec.Body.String(), tc.body)
+			}
+			replayed := tc.replay && tc.dup
+			if got := rec.Header().Get("Idempotent-Replayed") == "true"; got != replayed {
+				t.Errorf("Idempotent-Replayed = %q, want it set: %t", rec.Header().Get("Idempotent-Replayed"), replayed)
+			}
+			if replayed && rec.Header().Get("X-Call") != "1" {
+				t.Errorf("X-Call = %q, want the first response's headers", rec.Header().Get("X-Call"))
+			}
+
+			warning := `[WARN] duplicate Idempotency-Key "a" on POST /orders (seen 2 times in `
+			if got := strings.Contains(logs.String(), warning); got != tc.dup {
+				t.Errorf("logs = %q, want the duplicate logged: %t", logs, tc.dup)
+			}
+		})
+	}
+}
+
+func TestIdempotencyWithoutKey(t *testing.T) {
+	logs := captureLog(t)
+	var calls int
+	h := withIdempotency(newIdempotencyStore(realClock{}, time.Minute, 10), true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	}
+	if calls != 2 || logs.String() != "" {
+		t.Errorf("requests without a key: %d calls, logs %q; want both served unlogged", calls, logs)
+	}
+}
+
+func TestIdempotencyReplayOversized(t *testing.T) {
+	captureLog(t)
+	var calls int
+	h := withIdempotency(newIdempotencyStore(realClock{}, time.Minute, 10), true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write(make([]byte, idempotencyMaxBody+1))
+	}))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Idempotency-Key", "big")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Body.Len() != idempotencyMaxBody+1 || rec.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("response %d: %d bytes, Idempotent-Replayed %q; want it served in full", i+1, rec.Body.Len(), rec.Header().Get("Idempotent-Replayed"))
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want a response too big to keep served again", calls)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// inFlightSet tracks the method and path of requests that are currently being
+// served.
+type inFlightSet struct {
+	mu       sync.Mutex
+	requests map[*http.Request]string
+}
+
+func newInFlightSet() *inFlightSet {
+	return &inFlightSet{requests: make(map[*http.Request]string)}
+}
+
+// add records r as in flight.
+func (s *inFlightSet) add(r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[r] = r.Method + " " + r.URL.Path
+}
+
+// remove forgets r once it has been served.
+func (s *inFlightSet) remove(r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.requests, r)
+}
+
+// list returns the in-flight requests as sorted "METHOD path" strings.
+func (s *inFlightSet) list() []string {
+	s.mu.Lock()
+	out := make([]string, 0, len(s.requests))
+	for _, req := range s.requests {
+		out = append(out, req)
+	}
+	s.mu.Unlock()
+
+	sort.Strings(out)
+	return out
+}
+
+// logInFlight logs the requests in s, saying when they were in flight.
+func logInFlight(s *inFlightSet, when string) {
+	reqs := s.list()
+	log.Printf("[INFO] %d request(s) in flight %s", len(reqs), when)
+	for _, req := range reqs {
+		log.Printf("[INFO] in flight: %s", req)
+	}
+}
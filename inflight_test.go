@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInFlightSet(t *testing.T) {
+	s := newInFlightSet()
+	a := httptest.NewRequest(http.MethodGet, "/b", nil)
+	b := httptest.NewRequest(http.MethodPost, "/a", nil)
+	s.add(a)
+	s.add(b)
+	if got, want := s.list(), []string{"GET /b", "POST /a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list() = %v, want %v", got, want)
+	}
+	s.remove(a)
+	if got, want := s.list(), []string{"POST /a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list() after remove = %v, want %v", got, want)
+	}
+}
+
+func TestShutdownLogsInFlightPaths(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-shutdown-log-inflight-paths", "-allow-delay-header")
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		req, _ := http.NewRequest(http.MethodGet, s.url+"/held", nil)
+		req.Header.Set("X-Echo-Delay", "500ms")
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	// Wait for the request to be in flight before shutting down.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, body := s.get(t, "/metrics"); strings.Contains(body, "http_echo_in_flight_requests 1\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request never went in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := s.stop(t); code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	<-doneCh
+
+	logs := s.logs.String()
+	for _, want := range []string{"[INFO] 1 request(s) in flight when shutdown started", "[INFO] in flight: GET /held"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("logs = %q, want them to contain %q", logs, want)
+		}
+	}
+}
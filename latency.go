@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindow is the number of recent request durations kept for /latency.
+const latencyWindow = 1024
+
+// latencyRing keeps the most recent request durations in a fixed-size ring
+// buffer.
+type latencyRing struct {
+	mu   sync.Mutex
+	durs []time.Duration
+	next int
+	full bool
+}
+
+func newLatencyRing(size int) *latencyRing {
+	return &latencyRing{durs: make([]time.Duration, size)}
+}
+
+// record adds d to the ring, overwriting the oldest entry when full.
+func (l *latencyRing) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.durs[l.next] = d
+	l.next++
+	if l.next == len(l.durs) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// snapshot returns a sorted copy of the recorded durations.
+func (l *latencyRing) snapshot() []time.Duration {
+	l.mu.Lock()
+	n := l.next
+	if l.full {
+		n = len(l.durs)
+	}
+	durs := make([]time.Duration, n)
+	copy(durs, l.durs[:n])
+	l.mu.Unlock()
+
+	sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+	return durs
+}
+
+// percentile returns the p-th percentile (0-100) of sorted, or 0 if empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// httpLatency reports percentiles of recent request durations in
+// milliseconds.
+func httpLatency(l *latencyRing, pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		durs := l.snapshot()
+		ms := func(d time.Duration) float64 {
+			return float64(d) / float64(time.Millisecond)
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"count":  len(durs),
+			"p50_ms": ms(percentile(durs, 50)),
+			"p90_ms": ms(percentile(durs, 90)),
+			"p99_ms": ms(percentile(durs, 99)),
+		}, pretty)
+	}
+}
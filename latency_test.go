@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	c := newFakeClock(time.Now())
+	ring := newLatencyRing(latencyWindow)
+	l := &accessLogger{out: io.Discard, clock: c, timeFormat: httpLogDateFormat, latencies: ring}
+
+	// Requests taking 1ms through 100ms, in an order unlike their sorted one.
+	h := httpLog(l, func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("take"))
+		c.Advance(d)
+	})
+	for i := 0; i < 100; i++ {
+		ms := (i*37)%100 + 1
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?take="+(time.Duration(ms)*time.Millisecond).String(), nil))
+	}
+
+	rec := httptest.NewRecorder()
+	httpLatency(ring, false)(rec, httptest.NewRequest(http.MethodGet, "/latency", nil))
+	var got struct {
+		Count int     `json:"count"`
+		P50   float64 `json:"p50_ms"`
+		P90   float64 `json:"p90_ms"`
+		P99   float64 `json:"p99_ms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Count != 100 || got.P50 != 50 || got.P90 != 90 || got.P99 != 99 {
+		t.Errorf("/latency = %s, want count 100 and p50/p90/p99 of 50/90/99ms", rec.Body)
+	}
+}
+
+func TestLatencyRingWraps(t *testing.T) {
+	ring := newLatencyRing(3)
+	for _, d := range []time.Duration{5, 1, 4, 2} {
+		ring.record(d)
+	}
+
+	got := ring.snapshot()
+	want := []time.Duration{1, 2, 4}
+	if len(got) != len(want) {
+		t.Fatalf("snapshot = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("snapshot = %v, want %v", got, want)
+		}
+	}
+
+	if p := percentile(nil, 50); p != 0 {
+		t.Errorf("percentile of nothing = %s, want 0", p)
+	}
+}
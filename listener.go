@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listen opens a listener for addr, which is either a host:port pair on
+// network or a unix socket given as unix:/path. Unix socket files get
+// unixMode as their permissions, unless it is 0, and are removed again when
+// the listener is closed.
+func listen(network, addr string, unixMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen(network, addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if unixMode != 0 {
+		if err := os.Chmod(path, unixMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// fileListener returns a listener for the already-bound socket inherited as
+// file descriptor fd, as passed by systemd socket activation.
+func fileListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), "listener")
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+	}
+	return ln, nil
+}
+
+// keepAliveListener sets TCP keep-alive options on accepted connections.
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+// Accept implements the net.Listener interface.
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.SetKeepAlive(true); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.SetKeepAlivePeriod(l.period); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// minAcceptBackoff is the first pause after a temporary accept error.
+const minAcceptBackoff = 5 * time.Millisecond
+
+// backoffListener retries temporary accept errors, such as running out of
+// file descriptors, after a pause that doubles on each consecutive failure up
+// to max, rather than spinning on them. Because the errors never reach
+// http.Server, this replaces Serve's own backoff and its fixed 1s cap with
+// the configurable max. Close interrupts a pause in progress.
+type backoffListener struct {
+	net.Listener
+	max time.Duration
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func newBackoffListener(ln net.Listener, max time.Duration) *backoffListener {
+	return &backoffListener{Listener: ln, max: max, closeCh: make(chan struct{})}
+}
+
+// Accept implements the net.Listener interface.
+func (l *backoffListener) Accept() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		c, err := l.Listener.Accept()
+		var ne net.Error
+		if err == nil || !errors.As(err, &ne) || !ne.Temporary() {
+			return c, err
+		}
+
+		if delay == 0 {
+			delay = minAcceptBackoff
+		} else {
+			delay *= 2
+		}
+		if delay > l.max {
+			delay = l.max
+		}
+		log.Printf("[WARN] accept on %s failed: %s; retrying in %s", l.Addr(), err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-l.closeCh:
+			timer.Stop()
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// Close implements the net.Listener interface.
+func (l *backoffListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+	return l.Listener.Close()
+}
+
+// serveTCPHealth accepts connections on ln and closes them straight away, for
+// load balancers that only check whether a port accepts connections. It
+// returns once ln is closed.
+func serveTCPHealth(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+	}
+}
+
+// serveListeners serves server on each of listeners in the background, over
+// TLS if the server has a TLS config. All listeners share the server, so a
+// single Shutdown drains them all. A keepAlive period, if positive, is set on
+// accepted TCP connections.
+//
+// readyCh, if not nil, is closed once every listener is accepting
+// connections; run passes its own readyCh through. The first error, other
+// than http.ErrServerClosed, that stops a listener being served is sent on
+// errCh if there's room.
+//
+// Temporary accept errors are retried with a backoff of at most maxBackoff.
+func serveListeners(server *http.Server, listeners []net.Listener, keepAlive, maxBackoff time.Duration, readyCh chan<- struct{}, errCh chan<- error) {
+	serve := server.Serve
+	if server.TLSConfig != nil {
+		// Certificates are already loaded into the TLS config.
+		serve = func(ln net.Listener) error { return server.ServeTLS(ln, "", "") }
+	}
+
+	for _, ln := range listeners {
+		if tl, ok := ln.(*net.TCPListener); ok && keepAlive > 0 {
+			ln = &keepAliveListener{TCPListener: tl, period: keepAlive}
+		}
+		ln = newBackoffListener(ln, maxBackoff)
+		go func(ln net.Listener) {
+			log.Printf("[INFO] server is listening on %s\n", ln.Addr())
+			if err := serve(ln); err != http.ErrServerClosed {
+				reportServeError(errCh, fmt.Errorf("server exited with: %w", err))
+			}
+		}(ln)
+	}
+
+	// The listeners are bound, so connections queue in the accept backlog
+	// until the goroutines above pick them up.
+	if readyCh != nil {
+		close(readyCh)
+	}
+}
+
+// logConnState logs each connection state transition, for use as an
+// http.Server ConnState hook.
+func logConnState(conn net.Conn, state http.ConnState) {
+	log.Printf("[DEBUG] connection %s -> %s: %s", conn.RemoteAddr(), conn.LocalAddr(), state)
+}
+
+// idleTimeout408 closes connections that stay idle for timeout, first
+// writing a 408 Request Timeout so clients see why, rather than the silent
+// close http.Server's own IdleTimeout gives. Its hook method is used as an
+// http.Server ConnState hook.
+type idleTimeout408 struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	timers map[net.Conn]*time.Timer
+}
+
+func newIdleTimeout408(timeout time.Duration) *idleTimeout408 {
+	return &idleTimeout408{timeout: timeout, timers: make(map[net.Conn]*time.Timer)}
+}
+
+// idleTimeoutResponse is written to connections that hit the idle timeout.
+const idleTimeoutResponse = "HTTP/1.1 408 Request Timeout\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
+// hook starts the idle timer when conn is waiting for a request and stops it
+// once a request arrives or the connection goes away.
+func (t *idleTimeout408) hook(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timer, ok := t.timers[conn]; ok {
+		timer.Stop()
+		delete(t.timers, conn)
+	}
+	if state != http.StateNew && state != http.StateIdle {
+		return
+	}
+	t.timers[conn] = time.AfterFunc(t.timeout, func() {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(idleTimeoutResponse))
+		conn.Close()
+	})
+}
+
+// startupHealthcheckTimeout bounds the -startup-healthcheck request.
+const startupHealthcheckTimeout = 5 * time.Second
+
+// checkStartup requests path from the server listening on ln over loopback,
+// over TLS if useTLS is set, and returns an error unless it responds 200.
+func checkStartup(ln net.Listener, useTLS bool, path string) error {
+	addr := ln.Addr()
+	transport := &http.Transport{
+		// The check is against ourselves, whatever the certificate says.
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	host := addr.String()
+	if addr.Network() == "unix" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr.String())
+		}
+		host = "localhost"
+	} else if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.IsUnspecified() {
+		loopback := net.IPv4(127, 0, 0, 1)
+		if tcp.IP.To4() == nil {
+			loopback = net.IPv6loopback
+		}
+		host = net.JoinHostPort(loopback.String(), strconv.Itoa(tcp.Port))
+	}
+	defer transport.CloseIdleConnections()
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	client := &http.Client{Transport: transport, Timeout: startupHealthcheckTimeout}
+	resp, err := client.Get(scheme + "://" + host + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s", path, resp.Status)
+	}
+	return nil
+}
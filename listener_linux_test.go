@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveListenerSetsOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	kl := &keepAliveListener{TCPListener: ln.(*net.TCPListener), period: 42 * time.Second}
+
+	dialer := &net.Dialer{KeepAlive: -1}
+	client, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := kl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keepAlive, idle int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		keepAlive, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if sockErr == nil {
+			idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		}
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	if keepAlive == 0 {
+		t.Error("SO_KEEPALIVE is not set on the accepted connection")
+	}
+	if idle != 42 {
+		t.Errorf("TCP_KEEPIDLE = %d, want 42", idle)
+	}
+}
+
+func TestListenFD(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	f, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hand over a descriptor no *os.File owns, as an inherited one would be,
+	// since fileListener closes it.
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := startServer(t, "-text", "inherited", "-listen-fd", strconv.Itoa(fd))
+	s.url = "http://" + addr
+	if _, body := s.get(t, "/"); body != "inherited\n" {
+		t.Errorf("body = %q, want %q", body, "inherited\n")
+	}
+}
+
+// socketPath returns a path for a unix socket in a new temporary directory,
+// kept short to stay within the socket path length limit.
+func socketPath(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "echo.sock")
+}
+
+// unixClient returns a client that sends every request to the socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestListenTCPAndUnix(t *testing.T) {
+	addr, sock := freeAddr(t), socketPath(t)
+	s := startServer(t, "-text", "both", "-listen", addr+",unix:"+sock)
+
+	s.url = "http://" + addr
+	if _, body := s.get(t, "/"); body != "both\n" {
+		t.Errorf("body over TCP = %q, want %q", body, "both\n")
+	}
+
+	client := unixClient(sock)
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "both\n" {
+		t.Errorf("body over the unix socket = %q, want %q", b, "both\n")
+	}
+
+	// Closing the listener removes the socket file.
+	s.stop(t)
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after shutdown: %v", err)
+	}
+}
+
+func TestUnixMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0o600, 0o660} {
+		sock := socketPath(t)
+		s := startServer(t, "-text", "hi", "-listen", "unix:"+sock, "-unix-mode", strconv.FormatUint(uint64(mode), 8))
+
+		fi, err := os.Stat(sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != mode {
+			t.Errorf("-unix-mode %o: socket mode = %s", mode, fi.Mode())
+		}
+		s.stop(t)
+	}
+
+	for _, mode := range []string{"0", "999", "rw", "01777"} {
+		if _, stderr, code := runMain(t, "-text", "hi", "-unix-mode", mode); code != 127 || !strings.Contains(stderr, "Invalid -unix-mode") {
+			t.Errorf("-unix-mode %s: exit %d, stderr %q", mode, code, stderr)
+		}
+	}
+}
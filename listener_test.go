@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTCPKeepAliveServes(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-tcp-keepalive", "15s")
+
+	// The client doesn't enable keep-alives itself, so any on the
+	// connection come from the server's side.
+	dialer := &net.Dialer{KeepAlive: -1}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := client.Get(s.url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "hi\n" {
+		t.Errorf("body = %q, want %q", b, "hi\n")
+	}
+}
+
+func TestNetworkTCP4(t *testing.T) {
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	s := startServer(t, "-text", "v4", "-network", "tcp4", "-listen", ":"+port)
+
+	s.url = "http://127.0.0.1:" + port
+	if _, body := s.get(t, "/"); body != "v4\n" {
+		t.Errorf("body over IPv4 = %q, want %q", body, "v4\n")
+	}
+
+	// A tcp4 listener doesn't accept IPv6 connections, where the host has
+	// IPv6 at all.
+	if c, err := net.Dial("tcp6", "[::1]:"+port); err == nil {
+		c.Close()
+		t.Error("connected over IPv6 to a tcp4 listener")
+	}
+
+	_, stderr, code := runMain(t, "-text", "v4", "-network", "udp")
+	if code != 127 || !strings.Contains(stderr, "Invalid -network") {
+		t.Errorf("-network udp: exit code %d, stderr %q; want 127 and an invalid -network error", code, stderr)
+	}
+}
+
+func TestTCPHealth(t *testing.T) {
+	healthAddr := freeAddr(t)
+	s := startServer(t, "-text", "hi", "-tcp-health", healthAddr, "-preshutdown-delay", "2s")
+
+	dialOK := func() bool {
+		c, err := net.DialTimeout("tcp", healthAddr, time.Second)
+		if err != nil {
+			return false
+		}
+		defer c.Close()
+		// The check listener closes accepted connections straight away.
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = c.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	if !dialOK() {
+		t.Fatal("TCP health port refused a connection while ready")
+	}
+
+	// During -preshutdown-delay the HTTP listener still serves, but the
+	// health port refuses connections.
+	s.cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for dialOK() {
+		if time.Now().After(deadline) {
+			t.Fatal("TCP health port still accepting connections during shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, body := s.get(t, "/"); body != "hi\n" {
+		t.Errorf("body during the pre-shutdown delay = %q, want the echo", body)
+	}
+}
+
+func TestServeListenersReadyCh(t *testing.T) {
+	captureLog(t)
+
+	var listeners []net.Listener
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ready\n")
+	})}
+	defer server.Close()
+
+	readyCh := make(chan struct{})
+	serveListeners(server, listeners, 0, time.Second, readyCh, nil)
+	select {
+	case <-readyCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readyCh was not closed")
+	}
+
+	// No sleeps: every listener takes requests as soon as readyCh closes.
+	for _, ln := range listeners {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "ready\n" {
+			t.Errorf("%s: body = %q, want %q", ln.Addr(), b, "ready\n")
+		}
+	}
+}
+
+func TestRunReadyCh(t *testing.T) {
+	addr := freeAddr(t)
+	resetFlags(t, "-text", "hi", "-listen", addr)
+	captureLog(t)
+	accessLog, err := os.CreateTemp(t.TempDir(), "access.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout := stdoutW
+	stdoutW = accessLog
+	defer func() { stdoutW = oldStdout }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	readyCh := make(chan struct{})
+	exitCh := make(chan int, 1)
+	go func() { exitCh <- run(ctx, readyCh) }()
+
+	<-readyCh
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("request right after readyCh closed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+
+	cancel()
+	if code := <-exitCh; code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+}
+
+func TestLogConnState(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-log-conn-state")
+
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: echo\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	conn.Close()
+
+	// The server notices the close on its next read of the connection.
+	prefix := "[DEBUG] connection " + conn.LocalAddr().String() + " -> " + s.addr + ": "
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(s.logs.String(), prefix+"closed") {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection close never logged:\n%s", s.logs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var states []string
+	for _, line := range strings.Split(s.logs.String(), "\n") {
+		if _, state, ok := strings.Cut(line, prefix); ok {
+			states = append(states, state)
+		}
+	}
+	if want := []string{"new", "active", "idle", "closed"}; strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Errorf("logged connection states %v, want %v", states, want)
+	}
+}
+
+func TestIdleTimeout408(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want int // status of the response to the idle connection, or 0 for none
+	}{
+		{"silent close", nil, 0},
+		{"408", []string{"-idle-timeout-408"}, http.StatusRequestTimeout},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := startServer(t, append([]string{"-text", "hi", "-idle-timeout", "200ms"}, tc.args...)...)
+
+			conn, err := net.Dial("tcp", s.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			br := bufio.NewReader(conn)
+
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: echo\r\n\r\n")
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			// Leave the connection idle until the server gives up on it.
+			start := time.Now()
+			resp, err = http.ReadResponse(br, nil)
+			if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 3*time.Second {
+				t.Errorf("connection ended after %s idle, want about 200ms", elapsed)
+			}
+			if tc.want == 0 {
+				if err == nil {
+					t.Errorf("idle connection got a %d response, want a silent close", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reading the idle timeout response: %s", err)
+			}
+			if resp.StatusCode != tc.want || !resp.Close {
+				t.Errorf("idle timeout response = %d (close %t), want %d and close", resp.StatusCode, resp.Close, tc.want)
+			}
+			if _, err := br.ReadByte(); err != io.EOF {
+				t.Errorf("read after the 408 = %v, want EOF", err)
+			}
+		})
+	}
+
+	if _, stderr, code := runMain(t, "-text", "hi", "-idle-timeout-408"); code != 127 || !strings.Contains(stderr, "requires -idle-timeout") {
+		t.Errorf("-idle-timeout-408 without -idle-timeout: exit %d, stderr %q", code, stderr)
+	}
+}
+
+// temporaryError is a net.Error that reports itself as temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails its first n Accepts with a temporary error, or every
+// Accept if n is negative.
+type failingListener struct {
+	net.Listener
+	n     int32
+	calls atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.n < 0 || l.calls.Add(1) <= l.n {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestBackoffListenerRecovers(t *testing.T) {
+	logs := captureLog(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "recovered\n")
+	})}
+	defer server.Close()
+	go server.Serve(newBackoffListener(&failingListener{Listener: ln, n: 5}, 20*time.Millisecond))
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "recovered\n" {
+			t.Errorf("request %d body = %q, want %q", i+1, b, "recovered\n")
+		}
+	}
+
+	// The pause doubles from 5ms and stays at the configured cap, well under
+	// the 1s http.Server would use on its own.
+	prefix := "[WARN] accept on " + ln.Addr().String() + " failed: too many open files; retrying in "
+	var delays []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if _, after, ok := strings.Cut(line, prefix); ok {
+			delays = append(delays, after)
+		}
+	}
+	if want := []string{"5ms", "10ms", "20ms", "20ms", "20ms"}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("retry delays = %q, want %q", delays, want)
+	}
+
+	// Other errors are returned as they are.
+	ln.Close()
+	if _, err := newBackoffListener(ln, time.Second).Accept(); err == nil {
+		t.Error("Accept on a closed listener succeeded")
+	}
+}
+
+func TestBackoffListenerCloseInterrupts(t *testing.T) {
+	logs := captureLog(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	serveCh := make(chan error, 1)
+	go func() { serveCh <- server.Serve(newBackoffListener(&failingListener{Listener: ln, n: -1}, time.Hour)) }()
+
+	// Wait for a pause longer than http.Server's own 1s cap, then shut down
+	// part way through it.
+	const want = "retrying in 1.28s"
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), want) {
+		t.Fatalf("logs = %q, want them to contain %q", logs, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown during a backoff: %s", err)
+	}
+	select {
+	case err := <-serveCh:
+		if err != http.ErrServerClosed {
+			t.Errorf("Serve = %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Serve did not return until the backoff ended")
+	}
+}
+
+func TestStartupHealthcheck(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-startup-healthcheck")
+	// The check runs once the listeners are up, so ready follows shortly.
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(s.logs.String(), "[INFO] ready\n") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logs := s.logs.String()
+	listening := strings.Index(logs, "[INFO] server is listening on "+s.addr)
+	ready := strings.Index(logs, "[INFO] ready\n")
+	if listening < 0 || ready < listening {
+		t.Errorf("logs = %q, want ready logged after the server is listening", logs)
+	}
+
+	// /health answers too slowly, so the request timeout turns it into a 503.
+	addr := freeAddr(t)
+	_, stderr, code := runMain(t, "-text", "hi", "-listen", addr, "-startup-healthcheck",
+		"-path-delay", "/health=1s", "-request-timeout", "10ms")
+	if code == 0 {
+		t.Error("exit code = 0 after a failed startup health check")
+	}
+	if !strings.Contains(stderr, "[ERR] startup health check failed: /health responded 503 Service Unavailable") {
+		t.Errorf("stderr = %q, want the failed check logged", stderr)
+	}
+	if strings.Contains(stderr, "[INFO] ready") {
+		t.Errorf("stderr = %q, want no ready line", stderr)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// errReader is an io.Reader that always fails with err.
+type errReader struct {
+	err error
+}
+
+// Read implements the io.Reader interface.
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// bodyBufferMax bounds how much of a request body is kept in memory to be
+// logged, even when -max-body is 0. The rest is streamed to handlers unread.
+const bodyBufferMax = 64 << 10
+
+// bufferBody reads up to limit bytes of the body of r and puts them back in
+// front of the rest, so the whole body can still be read by handlers. It
+// reports whether the body was longer than limit. If reading fails, handlers
+// see the same error after the part that was read.
+func bufferBody(r *http.Request, limit int) ([]byte, bool) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	var rest io.Reader = r.Body
+	if err != nil {
+		rest = errReader{err: err}
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), rest), r.Body}
+
+	if len(b) > limit {
+		return b[:limit], true
+	}
+	return b, false
+}
+
+// loggedBody returns body as it should appear in the access log. JSON bodies
+// have the values of fields named in redact replaced, at any depth, and are
+// left out if truncated, since they can't be redacted then; anything else is
+// truncated to max bytes.
+func loggedBody(contentType string, body []byte, truncated bool, redact map[string]bool, max int) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		if truncated {
+			return "[JSON body too large to redact]"
+		}
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			if b, err := json.Marshal(redactJSON(v, redact)); err == nil {
+				return string(b)
+			}
+		}
+	}
+
+	if len(body) > max {
+		return string(body[:max]) + "..."
+	}
+	if truncated {
+		return string(body) + "..."
+	}
+	return string(body)
+}
+
+// redactJSON replaces the values of object fields whose lowercased names are in
+// redact, recursing into nested objects and arrays.
+func redactJSON(v interface{}, redact map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, fv := range v {
+			if redact[strings.ToLower(k)] {
+				v[k] = "REDACTED"
+				continue
+			}
+			v[k] = redactJSON(fv, redact)
+		}
+	case []interface{}:
+		for i, ev := range v {
+			v[i] = redactJSON(ev, redact)
+		}
+	}
+	return v
+}
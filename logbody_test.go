@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLoggedBody(t *testing.T) {
+	redact := map[string]bool{"password": true, "token": true}
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		truncated   bool
+		want        string
+	}{
+		{"json", "application/json", `{"user":"ann","password":"hunter2"}`, false, `{"password":"REDACTED","user":"ann"}`},
+		{"nested json", "application/vnd.api+json; charset=utf-8", `{"auth":[{"Token":"abc"}]}`, false, `{"auth":[{"Token":"REDACTED"}]}`},
+		{"truncated json", "application/json", `{"password":"hun`, true, "[JSON body too large to redact]"},
+		{"invalid json", "application/json", `{"pass":`, false, `{"pass":`},
+		{"text", "text/plain", "short", false, "short"},
+		{"long text", "text/plain", "0123456789abc", false, "0123456789..."},
+		{"truncated text", "text/plain", "0123", true, "0123..."},
+	}
+	for _, tc := range cases {
+		if got := loggedBody(tc.contentType, []byte(tc.body), tc.truncated, redact, 10); got != tc.want {
+			t.Errorf("%s: logged %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLogBody(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-log-body", "-redact-json-fields", "password")
+
+	const body = `{"user":"ann","password":"hunter2"}`
+	resp, err := http.Post(s.url+"/digest", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digest struct {
+		Length int `json:"length"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&digest)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Handlers still see the whole body.
+	if digest.Length != len(body) {
+		t.Errorf("/digest read %d bytes, want %d", digest.Length, len(body))
+	}
+	s.stop(t)
+
+	logged := strings.Join(s.accessLogLines(t), "\n")
+	if strings.Contains(logged, "hunter2") {
+		t.Errorf("access log %q contains the password", logged)
+	}
+	if !strings.Contains(logged, strconv.Quote(`{"password":"REDACTED","user":"ann"}`)) {
+		t.Errorf("access log %q is missing the redacted body", logged)
+	}
+}
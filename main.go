@@ -1,141 +1,2931 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
 	"log"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	listenFlag = flag.String("listen", ":5678", "address and port to listen")
+	listenFlag = flag.String("listen", ":5678", "comma-separated addresses to listen on, as host:port or unix:/path/to/socket")
 	textFlag   = flag.String("text", "", "text to put on the webpage")
-	envFlag    = flag.String("env", "", "environment variable to echo to the webpage")
+	envFlag    = flag.String("env", "", "environment variable to echo to the webpage, or a comma-separated list to echo as KEY=value lines")
+
+	echoQueryParamFlag = flag.String("echo-query-param", "", "query parameter whose value, when present, overrides the echoed text")
+
+	maxResponseSizeFlag = flag.Int("max-response-size", 1<<20, "maximum size in bytes of generated response bodies")
+	maxStreamFlag       = flag.Int("max-stream", 100, "maximum number of objects /stream/{n} returns")
+	maxDecodedSizeFlag  = flag.Int64("max-decoded-size", 10<<20, "maximum size in bytes of request bodies after /decode decompresses them")
+
+	metricsNamespaceFlag = flag.String("metrics-namespace", "http_echo", "prefix for exported Prometheus metric names")
+
+	serverTimingFlag = flag.Bool("server-timing", false, "report handler processing time in a Server-Timing header")
+
+	failAfterFlag = flag.Uint64("fail-after", 0, "number of echo requests after which the health check fails (0 disables)")
+
+	startupDelayFlag = flag.Duration("startup-delay", 0, "time after start during which the server reports itself as not ready")
+
+	flapIntervalFlag = flag.Duration("flap-interval", 0, "length of alternating healthy and 503 windows for echo requests (0 disables)")
+
+	seedFlag = flag.Int64("seed", 0, "seed for all randomized behaviors (default seeds from the current time)")
+
+	panicRateFlag = flag.Float64("panic-rate", 0, "fraction of echo requests (0-1) that panic, to exercise panic recovery")
+
+	colorFlag = flag.String("color", "auto", "colorize access log status codes: auto (when stdout is a terminal), always or never")
+
+	heartbeatIntervalFlag = flag.Duration("heartbeat-interval", 0, "interval between heartbeat log lines (0 disables)")
+
+	accessLogExcludeFlag = flag.String("access-log-exclude", "/health,/metrics", "comma-separated path prefixes left out of the access log")
+
+	logBodyFlag          = flag.Bool("log-body", false, "add request bodies to the access log")
+	logBodyMaxFlag       = flag.Int("log-body-max", 1024, "number of bytes of non-JSON request bodies logged by -log-body")
+	redactJSONFieldsFlag = flag.String("redact-json-fields", "password,token,secret", "comma-separated JSON fields whose values -log-body redacts")
+
+	logFormatFlag = flag.String("log-format", "text", "access log format: text, or otel for JSON with OpenTelemetry HTTP attribute names")
+
+	logUTCFlag        = flag.Bool("log-utc", false, "write access log timestamps in UTC instead of local time")
+	logTimeFormatFlag = flag.String("log-time-format", "default", "access log timestamp format: default, rfc3339, rfc3339nano, unix or a Go time layout")
+
+	logAsyncFlag      = flag.Bool("log-async", false, "write access logs from a background goroutine")
+	logBufferSizeFlag = flag.Int("log-buffer-size", 1024, "number of access log lines buffered when -log-async is set")
+
+	tcpKeepAliveFlag = flag.Duration("tcp-keepalive", 0, "TCP keep-alive period for accepted connections (0 uses Go's default)")
+
+	transformFlag = flag.String("transform", "none", "case transform applied to the echoed text: upper, lower or none")
+
+	responseFlags    stringSliceFlag
+	selectHeaderFlag = flag.String("select-header", "", "request header whose value deterministically selects one of the -response values")
+
+	trustProxyFlag = flag.Bool("trust-proxy", false, "trust X-Forwarded-For when determining the client address")
+
+	readHeaderTimeoutFlag = flag.Duration("read-header-timeout", 5*time.Second, "time allowed to read request headers (0 disables)")
+	requestTimeoutFlag    = flag.Duration("request-timeout", 0, "time allowed to handle a request before responding with -timeout-status, except on streaming endpoints (0 disables)")
+	timeoutStatusFlag     = flag.Int("timeout-status", http.StatusServiceUnavailable, "status code of responses to requests that exceed -request-timeout")
+	timeoutBodyFlag       = flag.String("timeout-body", "request timed out", "body of responses to requests that exceed -request-timeout")
+	maxHeaderBytesFlag    = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size in bytes of request headers")
+
+	patternFlag = flag.String("pattern", "abcdefghij", "pattern repeated to build the body when -size is set")
+	sizeFlag    = flag.Int("size", 0, "respond with exactly this many bytes of -pattern instead of the text")
+
+	bodyRepeatUntilSizeFlag = flag.Bool("body-repeat-until-size", false, "build the -size body by repeating the text or env value instead of -pattern")
+
+	dependsOnFlags stringSliceFlag
+
+	slowThresholdFlag = flag.Duration("slow-threshold", 0, "only log requests that take longer than this (0 logs everything)")
+
+	checksumFlag = flag.String("checksum", "", "advertise a digest of the echoed body: md5, sha1 or sha256")
+
+	listenFDFlag = flag.Int("listen-fd", -1, "serve on this inherited listening socket file descriptor instead of -listen")
+
+	statusFlag      = flag.Int("status", http.StatusOK, "status code of echo responses")
+	statusBodyFlags stringSliceFlag
+
+	versionFlag = flag.Bool("version", false, "print the version and exit")
+
+	maxBodyFlag = flag.Int64("max-body", 10<<20, "maximum size in bytes of request bodies (0 disables the limit)")
+
+	unixModeFlag = flag.String("unix-mode", "", "octal permissions of unix sockets given in -listen, e.g. 0660 (default leaves them to the umask)")
+
+	networkFlag = flag.String("network", "tcp", "network to listen on: tcp, tcp4 or tcp6")
+
+	preShutdownExecFlag = flag.String("preshutdown-exec", "", "shell command to run before shutting down the server")
+
+	enableTraceFlag = flag.Bool("enable-trace", false, "reflect TRACE requests back to the client as message/http")
+
+	statusWeightsFlag = flag.String("status-weights", "", "pick the echo status per request by weight, e.g. 200=80,500=15,503=5")
+
+	drainTokenFlag       = flag.String("drain-token", "", "token that must be POSTed to /drain to trigger a graceful shutdown")
+	preShutdownDelayFlag = flag.Duration("preshutdown-delay", 0, "time to report not ready before shutting down the server")
+
+	gzipFlag        = flag.Bool("gzip", false, "compress responses for clients that accept gzip")
+	gzipLevelFlag   = flag.Int("gzip-level", gzip.DefaultCompression, "gzip compression level, 1-9 or -1 for the default")
+	gzipMinSizeFlag = flag.Int("gzip-min-size", 0, "only compress responses whose body is larger than this many bytes")
+
+	tlsCertFlags      stringSliceFlag
+	tlsKeyFlags       stringSliceFlag
+	tlsRejectSNIFlag  = flag.Bool("tls-reject-unknown-sni", false, "fail TLS handshakes for server names no -tls-cert matches")
+	minTLSVersionFlag = flag.String("min-tls-version", "1.2", "minimum TLS version to accept: 1.2 or 1.3")
+	tlsCiphersFlag    = flag.String("tls-ciphers", "", "comma-separated IANA names of the TLS 1.2 cipher suites to offer (default Go's)")
+
+	bodyEncodingFlag = flag.String("body-encoding", "raw", "encoding of the echoed text: raw, hex or base64")
+
+	stripHopHeadersFlag = flag.Bool("strip-hop-headers", false, "remove hop-by-hop headers such as Connection and Keep-Alive from responses")
+
+	allowDelayHeaderFlag = flag.Bool("allow-delay-header", false, "let clients delay echo responses with an X-Echo-Delay header")
+	maxDelayFlag         = flag.Duration("max-delay", 10*time.Second, "upper bound for delays requested with X-Echo-Delay")
+
+	readinessFileFlag = flag.String("readiness-file", "", "file that must exist for /ready to report ready")
+
+	adminListenFlag = flag.String("admin-listen", "", "address and port for a separate admin listener serving health, readiness and metrics")
+
+	robotsFlag        = flag.String("robots", "", "file served as /robots.txt (default disallows all crawlers)")
+	robotsNoIndexFlag = flag.Bool("robots-noindex", false, "add X-Robots-Tag: noindex to every response")
+
+	maxConcurrentFlag = flag.Int("max-concurrent", 0, "maximum number of echo requests processed at once (0 is unlimited)")
+	overflowFlag      = flag.String("overflow", "queue", "what to do with echo requests over -max-concurrent: queue or reject")
+
+	responsePrefixFlag = flag.String("response-prefix", "", "text written before the echoed text")
+	responseSuffixFlag = flag.String("response-suffix", "", "text written after the echoed text")
+
+	pathPrefixFlag = flag.String("path-prefix", "", "serve all endpoints under this path prefix, e.g. /echo")
+
+	respondOnceFlag = flag.Bool("respond-once", false, "shut down after serving a single echo request")
+
+	syslogFlag         = flag.Bool("syslog", false, "write access logs to syslog instead of stdout")
+	syslogAddrFlag     = flag.String("syslog-addr", "", "remote syslog address as [network://]host:port (default the local daemon)")
+	syslogFacilityFlag = flag.String("syslog-facility", "daemon", "syslog facility for access logs")
+	syslogSeverityFlag = flag.String("syslog-severity", "info", "syslog severity for access logs")
+
+	disableHealthFlag     = flag.Bool("disable-health", false, "respond 404 on /health instead of reporting health")
+	healthSimpleFlag      = flag.Bool("health-simple", false, "respond to /health with -health-response instead of a detailed JSON status")
+	healthResponseFlag    = flag.String("health-response", `{"status":"ok"}`, "body of /health responses, implies -health-simple")
+	healthContentTypeFlag = flag.String("health-content-type", "application/json", "content type of /health responses, implies -health-simple")
+
+	requestIDHeaderFlag = flag.String("request-id-header", "X-Request-ID", "header used to read, generate and echo a request ID (empty disables)")
+
+	generateTraceparentFlag = flag.Bool("generate-traceparent", false, "generate a W3C traceparent for requests that arrive without one")
+
+	responseHeaderOrderFlag = flag.String("response-header-order", "", "comma-separated header names written first, in this order, on HTTP/1.x responses other than streaming ones")
+
+	tcpHealthFlag = flag.String("tcp-health", "", "address of a TCP health check listener that accepts connections until shutdown begins")
+
+	earlyHintsFlag = flag.Bool("early-hints", false, "send a 103 Early Hints response with the -link headers before echo responses")
+	linkFlags      stringSliceFlag
+
+	templateFileFlag = flag.String("template-file", "", "html/template file rendered per request instead of the text, reloaded on SIGHUP")
+
+	recordFlag       = flag.Bool("record", false, "keep recent requests and serve them as JSON on /recorded")
+	recordSizeFlag   = flag.Int("record-size", 100, "number of requests kept by -record")
+	recordRedactFlag = flag.String("record-redact", "Authorization,Proxy-Authorization,Cookie", "comma-separated headers whose values -record redacts")
+
+	negotiateFlag = flag.Bool("negotiate", false, "respond to echo requests with JSON, XML or plain text according to the Accept header")
+
+	includeHostFlag = flag.Bool("include-host", false, "add the server hostname and local address to echo responses in X-Served-By")
+
+	pathDelayFlags stringSliceFlag
+
+	rejectContinueFlag = flag.Bool("reject-continue", false, "respond 417 to requests with Expect: 100-continue instead of accepting the body")
+
+	maxRequestsFlag = flag.Uint64("max-requests", 0, "number of echo requests served before further ones get 429 (0 disables)")
+
+	timestampsFlag = flag.Bool("timestamps", false, "add X-Request-Received and X-Response-Sent timestamps to echo responses")
+
+	gracefulTimeoutFlag = flag.Duration("graceful-timeout", 0, "time after shutdown begins at which remaining connections are closed and the process exits (0 disables)")
+
+	allowResetFlag = flag.Bool("allow-reset", false, "serve /reset, which drops the connection without responding")
+
+	echoCountFlag = flag.Bool("echo-count", false, "report the running total of echo requests in the X-Echo-Count header")
+
+	prettyJSONFlag = flag.Bool("pretty-json", false, "indent JSON responses")
+
+	exposeConfigFlag = flag.Bool("expose-config", false, "serve the effective flag values as JSON on /config, with secrets redacted")
+
+	flakyFailuresFlag = flag.Int("flaky-failures", 2, "number of requests per X-Flaky-Key that /flaky fails before succeeding")
+
+	shutdownLogInFlightPathsFlag = flag.Bool("shutdown-log-inflight-paths", false, "log the method and path of requests still in flight when shutdown starts")
+
+	logConnStateFlag = flag.Bool("log-conn-state", false, "log connections opening, going active or idle and closing")
+
+	idleTimeoutFlag    = flag.Duration("idle-timeout", 0, "close keep-alive connections idle for longer than this (0 for no limit)")
+	idleTimeout408Flag = flag.Bool("idle-timeout-408", false, "send a 408 Request Timeout before closing connections that hit -idle-timeout")
+
+	proxyTargetFlag = flag.String("proxy-target", "", "upstream URL to reverse proxy requests under -proxy-prefix to")
+	proxyPrefixFlag = flag.String("proxy-prefix", "/proxy/", "path prefix of requests forwarded to -proxy-target, stripped before forwarding")
+
+	textAppendRequestInfoFlag = flag.Bool("text-append-request-info", false, "append the request method and path to the echoed text, as [METHOD /path]")
+
+	acceptBackoffMaxFlag = flag.Duration("accept-backoff-max", time.Second, "longest pause between retries after temporary accept errors such as running out of file descriptors")
+
+	allowStatusHeaderFlag = flag.Bool("allow-status-header", false, "let requests choose the echo response status with an X-Echo-Status header")
+
+	controlSocketFlag = flag.String("control-socket", "", "unix socket path accepting get/set commands for the runtime delay, error-rate and maintenance settings")
+
+	ttfbDelayFlag = flag.Duration("ttfb-delay", 0, "delay before the first byte of each response, without slowing the rest of it")
+
+	allowTruncateFlag = flag.Bool("allow-truncate", false, "allow -truncate-bytes to send deliberately truncated responses")
+	truncateBytesFlag = flag.Int("truncate-bytes", 0, "declare a Content-Length this many bytes longer than the echo body, then close the connection (requires -allow-truncate)")
+
+	strictFlag = flag.Bool("strict", false, "exit with an error when no content option is given instead of serving the default page")
+
+	fuzzResponsesFlag = flag.Bool("fuzz-responses", false, "serve deliberately malformed HTTP responses on /malformed")
+
+	startupHealthcheckFlag = flag.Bool("startup-healthcheck", false, "request /health over loopback once listening and exit if it fails, logging ready only once it passes")
+
+	lineEndingFlag = flag.String("line-ending", "lf", "line ending of echoed text: lf or crlf")
+
+	pingIntervalFlag = flag.Duration("ping-interval", 0, "interval between newline heartbeats on the long-lived /keepalive stream (0 disables the endpoint)")
+
+	maxAgeJitterFlag = flag.Int("max-age-jitter", 0, "seconds by which /cache randomly raises or lowers each response's max-age")
+
+	idempotencyTTLFlag     = flag.Duration("idempotency-ttl", 0, "log requests repeating an Idempotency-Key seen within this window (0 disables)")
+	idempotencyMaxKeysFlag = flag.Int("idempotency-max-keys", 10000, "number of Idempotency-Key values remembered by -idempotency-ttl")
+	idempotencyReplayFlag  = flag.Bool("idempotency-replay", false, "answer repeated Idempotency-Key requests with the first response instead of serving them again")
+
+	stdinStreamFlag = flag.Bool("stdin-stream", false, "echo the lines read from stdin while running, one per request in turn")
+
+	hardDrainFlag = flag.Bool("hard-drain", false, "close keep-alive connections as soon as shutdown starts, before -preshutdown-delay, instead of allowing further requests")
 
 	// stdoutW and stderrW are for overriding in test.
 	stdoutW = os.Stdout
 	stderrW = os.Stderr
 )
 
-func main() {
-	flag.Parse()
+func init() {
+	flag.Var(&responseFlags, "response", "response body to select from by -select-header (repeatable)")
+	flag.Var(&tlsCertFlags, "tls-cert", "path to a PEM certificate, paired in order with -tls-key; serves HTTPS when set (repeatable)")
+	flag.Var(&tlsKeyFlags, "tls-key", "path to the PEM private key for the matching -tls-cert (repeatable)")
+	flag.Var(&statusBodyFlags, "status-body", "body for a status code as code=body, overriding the text (repeatable)")
+	flag.Var(&dependsOnFlags, "depends-on", "URL that must respond successfully for /ready to report ready (repeatable)")
+	flag.Var(&pathDelayFlags, "path-delay", "delay for requests under a path prefix as prefix=duration; the longest prefix wins (repeatable)")
+	flag.Var(&linkFlags, "link", "Link header value sent in 103 Early Hints when -early-hints is set (repeatable)")
+}
+
+func main() {
+	flag.Parse()
+
+	if *versionFlag {
+		fmt.Fprintln(stdoutW, versionString())
+		os.Exit(0)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals(*templateFileFlag != "")...)
+	code := run(ctx, nil)
+	stop()
+	os.Exit(code)
+}
+
+// run serves as configured by the parsed flags until ctx is canceled, a drain
+// is requested or -respond-once is satisfied, then shuts down gracefully and
+// returns the process exit code: 127 for invalid flags, and 1 if the server
+// fails to start, stops serving or doesn't shut down within -graceful-timeout.
+// It never exits the process itself, so it can be embedded.
+//
+// readyCh, if not nil, is closed once the server is accepting connections, so
+// callers embedding the server can send requests without racing its startup.
+func run(ctx context.Context, readyCh chan<- struct{}) int {
+	clk := realClock{}
+	startedAt := clk.Now()
+
+	// stops undoes, in reverse, what startup has set running so far, should a
+	// later step fail. Once serving, shutdown takes over and it is cleared.
+	var stops []func()
+	defer func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}()
+
+	// Validation
+	if *textFlag == "" && *envFlag == "" && len(responseFlags) == 0 && *sizeFlag == 0 && *templateFileFlag == "" && !*stdinStreamFlag {
+		if *strictFlag {
+			fmt.Fprintln(stderrW, "Missing -text, -env, -response, -size, -stdin-stream or -template-file option!")
+			return 127
+		}
+		log.Printf("[INFO] no content option given, serving the default page")
+		*textFlag = defaultPage
+	}
+
+	if sources := contentSources(); len(sources) > 1 {
+		fmt.Fprintf(stderrW, "Conflicting %s options, only one may be set!\n", strings.Join(sources, ", "))
+		return 127
+	}
+
+	args := flag.Args()
+	if len(args) > 0 {
+		fmt.Fprintln(stderrW, "Too many arguments!")
+		return 127
+	}
+
+	listenAddrs := strings.Split(*listenFlag, ",")
+	for _, addr := range listenAddrs {
+		if strings.HasPrefix(addr, "unix:") {
+			if addr == "unix:" {
+				fmt.Fprintln(stderrW, "Invalid -listen address: unix socket path must not be empty")
+				return 127
+			}
+			continue
+		}
+		if err := validateListenAddr(addr); err != nil {
+			fmt.Fprintf(stderrW, "Invalid -listen address: %s\n", err)
+			return 127
+		}
+	}
+
+	if *adminListenFlag != "" {
+		if err := validateListenAddr(*adminListenFlag); err != nil {
+			fmt.Fprintf(stderrW, "Invalid -admin-listen address: %s\n", err)
+			return 127
+		}
+	}
+
+	if *tcpHealthFlag != "" {
+		if err := validateListenAddr(*tcpHealthFlag); err != nil {
+			fmt.Fprintf(stderrW, "Invalid -tcp-health address: %s\n", err)
+			return 127
+		}
+	}
+
+	var unixMode os.FileMode
+	if *unixModeFlag != "" {
+		mode, err := strconv.ParseUint(*unixModeFlag, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			fmt.Fprintf(stderrW, "Invalid -unix-mode: %q is not an octal permission mode\n", *unixModeFlag)
+			return 127
+		}
+		unixMode = os.FileMode(mode)
+	}
+
+	switch *networkFlag {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		fmt.Fprintf(stderrW, "Invalid -network: %q (must be tcp, tcp4 or tcp6)\n", *networkFlag)
+		return 127
+	}
+
+	if err := validateMetricsNamespace(*metricsNamespaceFlag); err != nil {
+		fmt.Fprintf(stderrW, "Invalid -metrics-namespace: %s\n", err)
+		return 127
+	}
+
+	if *panicRateFlag < 0 || *panicRateFlag > 1 {
+		fmt.Fprintln(stderrW, "Invalid -panic-rate: must be between 0 and 1")
+		return 127
+	}
+
+	if *tcpKeepAliveFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -tcp-keepalive: must not be negative")
+		return 127
+	}
+
+	if *sizeFlag < 0 || *sizeFlag > *maxResponseSizeFlag {
+		fmt.Fprintf(stderrW, "Invalid -size: must be between 0 and -max-response-size (%d)\n", *maxResponseSizeFlag)
+		return 127
+	}
+
+	if *bodyRepeatUntilSizeFlag && *sizeFlag == 0 {
+		fmt.Fprintln(stderrW, "Invalid -body-repeat-until-size: requires -size")
+		return 127
+	}
+
+	if *sizeFlag > 0 && *patternFlag == "" {
+		fmt.Fprintln(stderrW, "Invalid -pattern: must not be empty")
+		return 127
+	}
+
+	for _, dep := range dependsOnFlags {
+		if u, err := url.Parse(dep); err != nil || u.Scheme == "" || u.Host == "" {
+			fmt.Fprintf(stderrW, "Invalid -depends-on: %q is not an absolute URL\n", dep)
+			return 127
+		}
+	}
+
+	var proxyTarget *url.URL
+	if *proxyTargetFlag != "" {
+		var err error
+		proxyTarget, err = url.Parse(*proxyTargetFlag)
+		if err != nil || proxyTarget.Scheme == "" || proxyTarget.Host == "" {
+			fmt.Fprintf(stderrW, "Invalid -proxy-target: %q is not an absolute URL\n", *proxyTargetFlag)
+			return 127
+		}
+		if !strings.HasPrefix(*proxyPrefixFlag, "/") || !strings.HasSuffix(*proxyPrefixFlag, "/") {
+			fmt.Fprintln(stderrW, "Invalid -proxy-prefix: must start and end with /")
+			return 127
+		}
+		if strings.ContainsAny(*proxyPrefixFlag, "{}") {
+			// The prefix is stripped as is, so it can't hold wildcards.
+			fmt.Fprintln(stderrW, "Invalid -proxy-prefix: must not contain { or }")
+			return 127
+		}
+	}
+
+	if _, ok := checksumHashes[*checksumFlag]; *checksumFlag != "" && !ok {
+		fmt.Fprintf(stderrW, "Invalid -checksum: unknown algorithm %q (must be md5, sha1 or sha256)\n", *checksumFlag)
+		return 127
+	}
+
+	if !validStatus(*statusFlag) {
+		fmt.Fprintf(stderrW, "Invalid -status: %d is not a valid status code\n", *statusFlag)
+		return 127
+	}
+
+	statusBodies, err := parseStatusBodies(statusBodyFlags)
+	if err != nil {
+		fmt.Fprintf(stderrW, "Invalid -status-body: %s\n", err)
+		return 127
+	}
+
+	if *preShutdownDelayFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -preshutdown-delay: must not be negative")
+		return 127
+	}
+
+	if !validGzipLevel(*gzipLevelFlag) {
+		fmt.Fprintf(stderrW, "Invalid -gzip-level: %d (must be 1-9 or -1)\n", *gzipLevelFlag)
+		return 127
+	}
+
+	if len(tlsCertFlags) != len(tlsKeyFlags) {
+		fmt.Fprintln(stderrW, "Each -tls-cert must have a matching -tls-key!")
+		return 127
+	}
+
+	minTLSVersion, err := parseTLSVersion(*minTLSVersionFlag)
+	if err != nil {
+		fmt.Fprintf(stderrW, "Invalid -min-tls-version: %s\n", err)
+		return 127
+	}
+
+	var cipherSuites []uint16
+	if *tlsCiphersFlag != "" {
+		cipherSuites, err = parseCipherSuites(*tlsCiphersFlag)
+		if err != nil {
+			fmt.Fprintf(stderrW, "Invalid -tls-ciphers: %s\n", err)
+			return 127
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if len(tlsCertFlags) > 0 {
+		certs, err := loadCertificates(tlsCertFlags, tlsKeyFlags)
+		if err != nil {
+			fmt.Fprintf(stderrW, "Invalid -tls-cert or -tls-key: %s\n", err)
+			return 127
+		}
+		sni := &sniCertificates{certs: certs, rejectUnknown: *tlsRejectSNIFlag}
+		tlsConfig = &tls.Config{
+			GetCertificate: sni.getCertificate,
+			MinVersion:     minTLSVersion,
+			CipherSuites:   cipherSuites,
+		}
+	}
+
+	if *maxDelayFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -max-delay: must not be negative")
+		return 127
+	}
+
+	robots := []byte(defaultRobots)
+	if *robotsFlag != "" {
+		robots, err = os.ReadFile(*robotsFlag)
+		if err != nil {
+			fmt.Fprintf(stderrW, "Invalid -robots: %s\n", err)
+			return 127
+		}
+	}
+
+	if *maxConcurrentFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -max-concurrent: must not be negative")
+		return 127
+	}
+
+	if *overflowFlag != "queue" && *overflowFlag != "reject" {
+		fmt.Fprintf(stderrW, "Invalid -overflow: %q (must be queue or reject)\n", *overflowFlag)
+		return 127
+	}
+
+	pathPrefix := strings.TrimRight(*pathPrefixFlag, "/")
+	if pathPrefix != "" && !strings.HasPrefix(pathPrefix, "/") {
+		pathPrefix = "/" + pathPrefix
+	}
+
+	if mt, _, _ := mime.ParseMediaType(*healthContentTypeFlag); mt == "application/json" || strings.HasSuffix(mt, "+json") {
+		if !json.Valid([]byte(*healthResponseFlag)) {
+			fmt.Fprintln(stderrW, "Invalid -health-response: must be valid JSON for a JSON -health-content-type")
+			return 127
+		}
+	}
+
+	if *flapIntervalFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -flap-interval: must not be negative")
+		return 127
+	}
+
+	if *logBodyMaxFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -log-body-max: must not be negative")
+		return 127
+	}
+
+	if *logTimeFormatFlag == "" {
+		fmt.Fprintln(stderrW, "Invalid -log-time-format: must not be empty")
+		return 127
+	}
+
+	if *heartbeatIntervalFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -heartbeat-interval: must not be negative")
+		return 127
+	}
+
+	var headerOrder []string
+	if *responseHeaderOrderFlag != "" {
+		headerOrder, err = parseHeaderOrder(*responseHeaderOrderFlag)
+		if err != nil {
+			fmt.Fprintf(stderrW, "Invalid -response-header-order: %s\n", err)
+			return 127
+		}
+	}
+
+	if *requestTimeoutFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -request-timeout: must not be negative")
+		return 127
+	}
+
+	if *maxStreamFlag <= 0 {
+		fmt.Fprintln(stderrW, "Invalid -max-stream: must be positive")
+		return 127
+	}
+
+	if *maxDecodedSizeFlag <= 0 {
+		fmt.Fprintln(stderrW, "Invalid -max-decoded-size: must be positive")
+		return 127
+	}
+
+	if *earlyHintsFlag && len(linkFlags) == 0 {
+		fmt.Fprintln(stderrW, "Invalid -early-hints: requires at least one -link")
+		return 127
+	}
+
+	if *recordSizeFlag <= 0 {
+		fmt.Fprintln(stderrW, "Invalid -record-size: must be positive")
+		return 127
+	}
+
+	if !validStatus(*timeoutStatusFlag) {
+		fmt.Fprintf(stderrW, "Invalid -timeout-status: %d is not a valid status code\n", *timeoutStatusFlag)
+		return 127
+	}
+
+	pathDelays, err := parsePathDelays(pathDelayFlags)
+	if err != nil {
+		fmt.Fprintf(stderrW, "Invalid -path-delay: %s\n", err)
+		return 127
+	}
+
+	if *gracefulTimeoutFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -graceful-timeout: must not be negative")
+		return 127
+	}
+
+	if *flakyFailuresFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -flaky-failures: must not be negative")
+		return 127
+	}
+
+	if *gzipMinSizeFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -gzip-min-size: must not be negative")
+		return 127
+	}
+
+	if *idleTimeout408Flag && *idleTimeoutFlag <= 0 {
+		fmt.Fprintln(stderrW, "Invalid -idle-timeout-408: requires -idle-timeout")
+		return 127
+	}
+
+	if *acceptBackoffMaxFlag <= 0 {
+		fmt.Fprintln(stderrW, "Invalid -accept-backoff-max: must be positive")
+		return 127
+	}
+
+	if *ttfbDelayFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -ttfb-delay: must not be negative")
+		return 127
+	}
+
+	if *truncateBytesFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -truncate-bytes: must not be negative")
+		return 127
+	}
+	if *truncateBytesFlag > 0 && !*allowTruncateFlag {
+		fmt.Fprintln(stderrW, "Invalid -truncate-bytes: requires -allow-truncate")
+		return 127
+	}
+
+	if *truncateBytesFlag > 0 && *requestTimeoutFlag > 0 {
+		fmt.Fprintln(stderrW, "Invalid -truncate-bytes: can't be combined with -request-timeout, which buffers the response")
+		return 127
+	}
+	if *truncateBytesFlag > 0 && *responseHeaderOrderFlag != "" {
+		fmt.Fprintln(stderrW, "Invalid -truncate-bytes: can't be combined with -response-header-order, which buffers the response")
+		return 127
+	}
+
+	if *startupHealthcheckFlag && *disableHealthFlag {
+		fmt.Fprintln(stderrW, "Invalid -startup-healthcheck: requires /health, which -disable-health turns off")
+		return 127
+	}
+
+	if *pingIntervalFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -ping-interval: must not be negative")
+		return 127
+	}
+
+	if *maxAgeJitterFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -max-age-jitter: must not be negative")
+		return 127
+	}
+
+	if *idempotencyTTLFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -idempotency-ttl: must not be negative")
+		return 127
+	}
+	if *idempotencyMaxKeysFlag < 1 {
+		fmt.Fprintln(stderrW, "Invalid -idempotency-max-keys: must be positive")
+		return 127
+	}
+
+	if *maxBodyFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -max-body: must not be negative")
+		return 127
+	}
+
+	if *readHeaderTimeoutFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -read-header-timeout: must not be negative")
+		return 127
+	}
+
+	if *maxHeaderBytesFlag < 1 {
+		fmt.Fprintln(stderrW, "Invalid -max-header-bytes: must be positive")
+		return 127
+	}
+
+	if *slowThresholdFlag < 0 {
+		fmt.Fprintln(stderrW, "Invalid -slow-threshold: must not be negative")
+		return 127
+	}
+
+	if *logBufferSizeFlag < 1 {
+		fmt.Fprintln(stderrW, "Invalid -log-buffer-size: must be positive")
+		return 127
+	}
+
+	transform, err := parseTransform(*transformFlag)
+	if err != nil {
+		fmt.Fprintf(stderrW, "Invalid -transform: %s\n", err)
+		return 127
+	}
+
+	switch *bodyEncodingFlag {
+	case "raw", "hex", "base64":
+	default:
+		fmt.Fprintf(stderrW, "Invalid -body-encoding: %q (must be raw, hex or base64)\n", *bodyEncodingFlag)
+		return 127
+	}
+
+	switch *logFormatFlag {
+	case "text", "otel":
+	default:
+		fmt.Fprintf(stderrW, "Invalid -log-format: %q (must be text or otel)\n", *logFormatFlag)
+		return 127
+	}
+
+	switch *lineEndingFlag {
+	case "lf", "crlf":
+	default:
+		fmt.Fprintf(stderrW, "Invalid -line-ending: %q (must be lf or crlf)\n", *lineEndingFlag)
+		return 127
+	}
+
+	switch *colorFlag {
+	case "auto", "always", "never":
+	default:
+		fmt.Fprintf(stderrW, "Invalid -color: %q (must be auto, always or never)\n", *colorFlag)
+		return 127
+	}
+
+	if !knownSyslogFacility(*syslogFacilityFlag) {
+		fmt.Fprintf(stderrW, "Invalid -syslog-facility: %q (must be a facility such as daemon, user or local0)\n", *syslogFacilityFlag)
+		return 127
+	}
+
+	if !knownSyslogSeverity(*syslogSeverityFlag) {
+		fmt.Fprintf(stderrW, "Invalid -syslog-severity: %q (must be a severity such as err, warning or info)\n", *syslogSeverityFlag)
+		return 127
+	}
+
+	var finalFlag string
+	var finalKind string
+
+	if *textFlag != "" {
+		finalFlag = *textFlag
+		finalKind = "text"
+	} else if *stdinStreamFlag {
+		finalKind = "stdin"
+	} else {
+		finalFlag = *envFlag
+		finalKind = "env"
+	}
+
+	accessLog := &accessLogger{
+		out:           stdoutW,
+		slowThreshold: *slowThresholdFlag,
+		latencies:     newLatencyRing(latencyWindow),
+		tlsFields:     len(tlsCertFlags) > 0,
+		clock:         clk,
+		utc:           *logUTCFlag,
+		timeFormat:    logTimeFormat(*logTimeFormatFlag),
+		otel:          *logFormatFlag == "otel",
+	}
+	if *accessLogExcludeFlag != "" {
+		accessLog.exclude = strings.Split(*accessLogExcludeFlag, ",")
+	}
+	if *shutdownLogInFlightPathsFlag {
+		accessLog.inFlight = newInFlightSet()
+	}
+	if *logBodyFlag {
+		accessLog.logBody = true
+		accessLog.bodyMax = *logBodyMaxFlag
+		accessLog.redactFields = make(map[string]bool)
+		for _, field := range strings.Split(*redactJSONFieldsFlag, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				accessLog.redactFields[strings.ToLower(field)] = true
+			}
+		}
+	}
+	if *syslogFlag {
+		w, err := newSyslogWriter(*syslogAddrFlag, *syslogFacilityFlag, *syslogSeverityFlag)
+		if err != nil {
+			log.Printf("[WARN] failed to connect to syslog, logging to stderr instead: %s", err)
+			accessLog.out = stderrW
+		} else {
+			accessLog.out = w
+		}
+	}
+	accessLog.color = *colorFlag == "always" || (*colorFlag == "auto" && isTerminal(accessLog.out))
+	var asyncLog *asyncWriter
+	if *logAsyncFlag {
+		asyncLog = newAsyncWriter(accessLog.out, *logBufferSizeFlag)
+		accessLog.out = asyncLog
+		stops = append(stops, func() { asyncLog.Close() })
+	}
+
+	m := newMetrics(*metricsNamespaceFlag)
+
+	// rng drives all randomized behaviors, so a given -seed reproduces them.
+	seed := clk.Now().UnixNano()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			seed = *seedFlag
+		}
+	})
+	rng := newRand(seed)
+
+	var statusWeights *weightedStatuses
+	if *statusWeightsFlag != "" {
+		statusWeights, err = parseStatusWeights(*statusWeightsFlag, rng)
+		if err != nil {
+			fmt.Fprintf(stderrW, "Invalid -status-weights: %s\n", err)
+			return 127
+		}
+	}
+
+	// served counts echo requests for features that react to traffic volume.
+	var served atomic.Uint64
+
+	echoOpts := echoOptions{
+		queryParam:    *echoQueryParamFlag,
+		transform:     transform,
+		encoding:      *bodyEncodingFlag,
+		prefix:        *responsePrefixFlag,
+		suffix:        *responseSuffixFlag,
+		responses:     responseFlags,
+		selectHeader:  *selectHeaderFlag,
+		pattern:       *patternFlag,
+		size:          *sizeFlag,
+		repeatText:    *bodyRepeatUntilSizeFlag,
+		checksum:      *checksumFlag,
+		status:        *statusFlag,
+		statusBodies:  statusBodies,
+		statusWeights: statusWeights,
+		requestInfo:   *textAppendRequestInfoFlag,
+		statusHeader:  *allowStatusHeaderFlag,
+		crlf:          *lineEndingFlag == "crlf",
+		prettyJSON:    *prettyJSONFlag,
+	}
+	stdinStopCh := make(chan struct{})
+	stdinDoneCh := make(chan struct{})
+	if *stdinStreamFlag {
+		echoOpts.stdin = &liveLines{}
+		go readLines(os.Stdin, echoOpts.stdin, stdinStopCh, stdinDoneCh)
+	} else {
+		close(stdinDoneCh)
+	}
+	stops = append(stops, func() {
+		close(stdinStopCh)
+		<-stdinDoneCh
+	})
+	echo := httpEcho(finalFlag, finalKind, echoOpts)
+	if *negotiateFlag {
+		echo = withNegotiation(httpJSONEcho(finalFlag, finalKind, echoOpts), httpXML(finalFlag, finalKind, echoOpts), echo)
+	}
+	if *templateFileFlag != "" {
+		page, err := newTemplatePage(*templateFileFlag)
+		if err != nil {
+			fmt.Fprintf(stderrW, "Invalid -template-file: %s\n", err)
+			return 127
+		}
+		if sigs := reloadSignals(); len(sigs) > 0 {
+			reloadCh := make(chan os.Signal, 1)
+			signal.Notify(reloadCh, sigs...)
+			go page.reloadOn(reloadCh)
+			defer func() {
+				signal.Stop(reloadCh)
+				close(reloadCh)
+			}()
+		}
+		echo = httpTemplate(page)
+	}
+	settings := &runtimeSettings{}
+	if *controlSocketFlag != "" {
+		echo = withRuntimeSettings(settings, clk, rng, echo)
+	}
+	if *truncateBytesFlag > 0 {
+		echo = withTruncate(clk, *truncateBytesFlag, echo)
+	}
+	if *panicRateFlag > 0 {
+		echo = withPanicRate(*panicRateFlag, rng, echo)
+	}
+	if *serverTimingFlag {
+		echo = withServerTiming(clk, echo)
+	}
+	if *timestampsFlag {
+		echo = withTimestamps(clk, echo)
+	}
+	if *allowDelayHeaderFlag {
+		echo = withDelayHeader(clk, *maxDelayFlag, echo)
+	}
+	if *enableTraceFlag {
+		echo = withTrace(echo)
+	}
+	if *earlyHintsFlag {
+		echo = withEarlyHints(linkFlags, echo)
+	}
+	if *includeHostFlag {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("[ERR] failed to get hostname for -include-host: %s", err)
+			return 1
+		}
+		echo = withServedBy(hostname, echo)
+	}
+	if *maxConcurrentFlag > 0 {
+		echo = withConcurrencyLimit(*maxConcurrentFlag, *overflowFlag == "reject", echo)
+	}
+	if *flapIntervalFlag > 0 {
+		echo = withFlap(clk, startedAt, *flapIntervalFlag, echo)
+	}
+	echo = withRequestCount(&served, *echoCountFlag, echo)
+	if *maxRequestsFlag > 0 {
+		echo = withMaxRequests(*maxRequestsFlag, echo)
+	}
+
+	ready := &readiness{
+		readyAt: startedAt.Add(*startupDelayFlag),
+		file:    *readinessFileFlag,
+	}
+	echo = withStartupDelay(clk, ready.readyAt, echo)
+
+	// Flag gets printed as a page
+	root := httpLog(accessLog, withMetrics(clk, m, withRecover(withAppHeaders(echo))))
+	respondedCh := make(chan struct{})
+	if *respondOnceFlag {
+		root = withRespondOnce(respondedCh, root)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", root)
+
+	// Random bytes endpoint
+	mux.HandleFunc("/bytes/", httpLog(accessLog, withAppHeaders(httpBytes(*maxResponseSizeFlag))))
+
+	// Drip endpoint
+	mux.HandleFunc("/drip", httpLog(accessLog, withAppHeaders(httpDrip(clk, *maxResponseSizeFlag))))
+
+	// Streaming JSON endpoint
+	mux.HandleFunc("/stream/", httpLog(accessLog, withAppHeaders(httpStream(finalFlag, finalKind, echoOpts, *maxStreamFlag))))
+
+	// Cache endpoint
+	mux.HandleFunc("/cache", httpLog(accessLog, withAppHeaders(httpCache(clk, *maxAgeJitterFlag, rng, echo))))
+
+	// Uncacheable echo endpoint
+	mux.HandleFunc("/no-cache", httpLog(accessLog, withAppHeaders(httpNoCache(echo))))
+
+	// XML endpoint
+	mux.HandleFunc("/xml", httpLog(accessLog, withAppHeaders(httpXML(finalFlag, finalKind, echoOpts))))
+
+	// Client IP endpoint
+	mux.HandleFunc("/ip", httpLog(accessLog, withAppHeaders(httpIP(*trustProxyFlag, *prettyJSONFlag))))
+
+	// Method echo endpoint
+	mux.HandleFunc("/method-echo", httpLog(accessLog, withAppHeaders(httpMethodEcho(*prettyJSONFlag))))
+
+	// User agent endpoint
+	mux.HandleFunc("/user-agent", httpLog(accessLog, withAppHeaders(httpUserAgent(*prettyJSONFlag))))
+
+	// Curl reproduction endpoint
+	mux.HandleFunc("/curl", httpLog(accessLog, withAppHeaders(httpCurl())))
+
+	// Form endpoint
+	mux.HandleFunc("/post", httpLog(accessLog, withAppHeaders(httpPost(*prettyJSONFlag))))
+
+	// Keep-alive stream endpoint
+	shutdownCh := make(chan struct{})
+	mux.HandleFunc("/keepalive", httpLog(accessLog, orNotFound(*pingIntervalFlag > 0, withAppHeaders(httpKeepalive(clk, *pingIntervalFlag, shutdownCh)))))
+
+	// Patch reflection endpoint
+	mux.HandleFunc("/patch", httpLog(accessLog, withAppHeaders(httpPatch())))
+
+	// Decompression endpoint
+	mux.HandleFunc("/decode", httpLog(accessLog, withAppHeaders(httpDecode(*maxDecodedSizeFlag))))
+
+	// Request recording endpoint
+	var recorder *requestRecorder
+	if *recordFlag {
+		var redact []string
+		if *recordRedactFlag != "" {
+			redact = strings.Split(*recordRedactFlag, ",")
+		}
+		recorder = newRequestRecorder(clk, *recordSizeFlag, redact)
+		mux.HandleFunc("/recorded", withAppHeaders(httpRecorded(recorder, *prettyJSONFlag)))
+	}
+
+	// Body digest endpoint
+	mux.HandleFunc("/digest", httpLog(accessLog, withAppHeaders(httpDigest(*prettyJSONFlag))))
+
+	// Route debugging endpoint
+	mux.HandleFunc("/route", httpLog(accessLog, withAppHeaders(httpRoute(mux, *prettyJSONFlag))))
+	mux.HandleFunc("/route/{segment}/{rest...}", httpLog(accessLog, withAppHeaders(httpRouteValues(*prettyJSONFlag))))
+
+	// Connection reset endpoint
+	if *allowResetFlag {
+		mux.HandleFunc("/reset", httpLog(accessLog, httpReset()))
+	}
+
+	// Trailer echo endpoint
+	mux.HandleFunc("/trailers", httpLog(accessLog, withAppHeaders(httpTrailers())))
+
+	// Configuration endpoint
+	mux.HandleFunc("/config", httpLog(accessLog, orNotFound(*exposeConfigFlag, withAppHeaders(httpConfig(effectiveConfig(), *prettyJSONFlag)))))
+
+	// Retry simulation endpoint
+	mux.HandleFunc("/flaky", httpLog(accessLog, withAppHeaders(httpFlaky(newFlakyTracker(clk, flakyTTL), *flakyFailuresFlag))))
+
+	// Malformed response endpoint
+	mux.HandleFunc("/malformed", httpLog(accessLog, orNotFound(*fuzzResponsesFlag, httpMalformed())))
+
+	// Cookie endpoints
+	mux.HandleFunc("/cookies", httpLog(accessLog, withAppHeaders(httpCookies(*prettyJSONFlag))))
+	mux.HandleFunc("/cookies/set", httpLog(accessLog, withAppHeaders(httpSetCookies(pathPrefix))))
+
+	// Basic auth endpoint
+	mux.HandleFunc("/basic-auth/", httpLog(accessLog, withAppHeaders(httpBasicAuth(*prettyJSONFlag))))
+
+	// Robots endpoint
+	mux.HandleFunc("/robots.txt", httpLog(accessLog, withAppHeaders(httpRobots(robots))))
+
+	// Health endpoint
+	healthSimple := *healthSimpleFlag
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "health-response" || f.Name == "health-content-type" {
+			healthSimple = true
+		}
+	})
+	health := withAppHeaders(httpHealthDetail(ready, clk, startedAt, *failAfterFlag, &served, *prettyJSONFlag))
+	if healthSimple {
+		health = withAppHeaders(httpHealth(*healthResponseFlag, *healthContentTypeFlag, *failAfterFlag, &served))
+	}
+	health = orNotFound(!*disableHealthFlag, health)
+	mux.HandleFunc("/health", httpLog(accessLog, health))
+
+	// Readiness endpoint
+	for _, dep := range dependsOnFlags {
+		ready.deps = append(ready.deps, newDependencyCheck(clk, dep))
+	}
+	readyHandler := withAppHeaders(httpReady(ready, clk, *prettyJSONFlag))
+	mux.HandleFunc("/ready", readyHandler)
+
+	// Drain endpoint
+	drainCh := make(chan struct{})
+	mux.HandleFunc("/drain", httpLog(accessLog, withAppHeaders(httpDrain(*drainTokenFlag, drainCh))))
+
+	// Latency percentiles endpoint
+	latency := withAppHeaders(httpLatency(accessLog.latencies, *prettyJSONFlag))
+	mux.HandleFunc("/latency", latency)
+
+	// Metrics endpoint
+	metricsHandler := withAppHeaders(httpMetrics(m))
+	mux.HandleFunc("/metrics", httpLog(accessLog, metricsHandler))
+
+	// Reverse proxy endpoint, registered last so it can be checked against
+	// every other one.
+	if proxyTarget != nil {
+		if _, pattern := mux.Handler(&http.Request{Method: http.MethodGet, URL: &url.URL{Path: *proxyPrefixFlag}}); pattern == *proxyPrefixFlag {
+			fmt.Fprintf(stderrW, "Invalid -proxy-prefix: %q is already an endpoint\n", *proxyPrefixFlag)
+			return 127
+		}
+		mux.HandleFunc(*proxyPrefixFlag, httpLog(accessLog, httpProxy(proxyTarget, *proxyPrefixFlag)))
+	}
+
+	// serveErrCh gets the first error that stops a server serving.
+	serveErrCh := make(chan error, 1)
+
+	// Admin endpoints are also served on their own listener when requested,
+	// so they can stay reachable while the public server drains.
+	var adminServer *http.Server
+	if *adminListenFlag != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/health", health)
+		adminMux.HandleFunc("/ready", readyHandler)
+		adminMux.HandleFunc("/latency", latency)
+		adminMux.HandleFunc("/metrics", metricsHandler)
+
+		adminServer = &http.Server{
+			Addr:              *adminListenFlag,
+			Handler:           adminMux,
+			ReadHeaderTimeout: *readHeaderTimeoutFlag,
+		}
+
+		adminLn, err := net.Listen(*networkFlag, *adminListenFlag)
+		if err != nil {
+			log.Printf("[ERR] failed to listen for admin server: %s", err)
+			return 1
+		}
+		go func() {
+			log.Printf("[INFO] admin server is listening on %s\n", adminLn.Addr())
+			if err := adminServer.Serve(adminLn); err != http.ErrServerClosed {
+				reportServeError(serveErrCh, fmt.Errorf("admin server exited with: %w", err))
+			}
+		}()
+		stops = append(stops, func() { adminServer.Close() })
+	}
+
+	var handler http.Handler = mux
+	if len(pathDelays) > 0 {
+		handler = withPathDelay(clk, pathDelays, handler)
+	}
+	if *ttfbDelayFlag > 0 {
+		handler = withTTFBDelay(clk, *ttfbDelayFlag, handler)
+	}
+	if recorder != nil {
+		handler = withRecord(recorder, handler)
+	}
+	if *idempotencyTTLFlag > 0 {
+		handler = withIdempotency(newIdempotencyStore(clk, *idempotencyTTLFlag, *idempotencyMaxKeysFlag), *idempotencyReplayFlag, handler)
+	}
+	if pathPrefix != "" {
+		prefixMux := http.NewServeMux()
+		prefixMux.Handle(pathPrefix+"/", http.StripPrefix(pathPrefix, handler))
+		handler = prefixMux
+	}
+	if *robotsNoIndexFlag {
+		handler = withNoIndex(handler)
+	}
+	if *stripHopHeadersFlag {
+		handler = withStripHopHeaders(handler)
+	}
+	if *gzipFlag {
+		handler = withGzip(*gzipLevelFlag, *gzipMinSizeFlag, handler)
+	}
+	if *maxBodyFlag > 0 {
+		handler = withMaxBody(*maxBodyFlag, handler)
+	}
+	if *rejectContinueFlag {
+		handler = withRejectContinue(handler)
+	}
+	if *requestTimeoutFlag > 0 {
+		handler = withStreamingBypass(pathPrefix, withTimeout(*requestTimeoutFlag, *timeoutStatusFlag, *timeoutBodyFlag, withRequestDeadline(handler)), handler)
+	}
+	handler = withTraceparent(*generateTraceparentFlag, rng, handler)
+	if *requestIDHeaderFlag != "" {
+		handler = withRequestID(*requestIDHeaderFlag, rng, handler)
+	}
+	if headerOrder != nil {
+		streaming := func(r *http.Request) bool { return isStreamingPath(pathPrefix, r.URL.Path) }
+		handler = withStreamingBypass(pathPrefix, withHeaderOrder(clk, headerOrder, shutdownCh, streaming, handler), handler)
+	}
+
+	server := &http.Server{
+		Addr:              *listenFlag,
+		Handler:           handler,
+		MaxHeaderBytes:    *maxHeaderBytesFlag,
+		ReadHeaderTimeout: *readHeaderTimeoutFlag,
+		TLSConfig:         tlsConfig,
+	}
+	var connStateHooks []func(net.Conn, http.ConnState)
+	if *logConnStateFlag {
+		connStateHooks = append(connStateHooks, logConnState)
+	}
+	if *idleTimeout408Flag {
+		// The hook enforces the timeout itself, so the server's own idle
+		// timeout can't close connections silently first.
+		connStateHooks = append(connStateHooks, newIdleTimeout408(*idleTimeoutFlag).hook)
+	} else {
+		server.IdleTimeout = *idleTimeoutFlag
+	}
+	if len(connStateHooks) > 0 {
+		server.ConnState = func(conn net.Conn, state http.ConnState) {
+			for _, hook := range connStateHooks {
+				hook(conn, state)
+			}
+		}
+	}
+
+	var listeners []net.Listener
+	if *listenFDFlag >= 0 {
+		ln, err := fileListener(*listenFDFlag)
+		if err != nil {
+			log.Printf("[ERR] failed to listen: %s", err)
+			return 1
+		}
+		listeners = append(listeners, ln)
+	} else {
+		for _, addr := range listenAddrs {
+			ln, err := listen(*networkFlag, addr, unixMode)
+			if err != nil {
+				log.Printf("[ERR] failed to listen: %s", err)
+				return 1
+			}
+			listeners = append(listeners, ln)
+			stops = append(stops, func() { ln.Close() })
+		}
+	}
+
+	serveListeners(server, listeners, *tcpKeepAliveFlag, *acceptBackoffMaxFlag, readyCh, serveErrCh)
+	stops = append(stops, func() { server.Close() })
+	if *startupHealthcheckFlag {
+		if err := checkStartup(listeners[0], tlsConfig != nil, pathPrefix+"/health"); err != nil {
+			log.Printf("[ERR] startup health check failed: %s", err)
+			return 1
+		}
+		log.Printf("[INFO] ready")
+	}
+
+	var tcpHealthLn net.Listener
+	if *tcpHealthFlag != "" {
+		tcpHealthLn, err = net.Listen(*networkFlag, *tcpHealthFlag)
+		if err != nil {
+			log.Printf("[ERR] failed to listen for TCP health checks: %s", err)
+			return 1
+		}
+		log.Printf("[INFO] TCP health check is listening on %s\n", tcpHealthLn.Addr())
+		go serveTCPHealth(tcpHealthLn)
+		stops = append(stops, func() { tcpHealthLn.Close() })
+	}
+
+	var controlLn net.Listener
+	if *controlSocketFlag != "" {
+		controlLn, err = listen("unix", "unix:"+*controlSocketFlag, 0o600)
+		if err != nil {
+			log.Printf("[ERR] failed to listen on control socket: %s", err)
+			return 1
+		}
+		log.Printf("[INFO] control socket is listening on %s\n", *controlSocketFlag)
+		go serveControl(controlLn, settings)
+		stops = append(stops, func() { controlLn.Close() })
+	}
+
+	heartbeatStopCh := make(chan struct{})
+	heartbeatDoneCh := make(chan struct{})
+	if *heartbeatIntervalFlag > 0 {
+		go runHeartbeat(*heartbeatIntervalFlag, startedAt, &served, heartbeatStopCh, heartbeatDoneCh)
+	} else {
+		close(heartbeatDoneCh)
+	}
+
+	// From here on shutdown stops everything itself.
+	stops = nil
+
+	// Wait for interrupt or a drain request
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		log.Printf("[INFO] received shutdown signal, shutting down...")
+	case <-drainCh:
+		log.Printf("[INFO] received drain request, shutting down...")
+	case <-respondedCh:
+		log.Printf("[INFO] served a request with -respond-once, shutting down...")
+	case serveErr = <-serveErrCh:
+		log.Printf("[ERR] %s, shutting down...", serveErr)
+	}
+
+	m.shutdownStarted()
+	if *hardDrainFlag {
+		// Shutdown stops keep-alives itself, but only after the preshutdown
+		// delay and exec. This closes idle connections now and has every
+		// response from here on carry Connection: close, so clients move
+		// off before the listener goes away.
+		server.SetKeepAlivesEnabled(false)
+	}
+	close(shutdownCh)
+	if accessLog.inFlight != nil {
+		logInFlight(accessLog.inFlight, "when shutdown started")
+	}
+
+	// timeoutCh is closed if shutdown overruns -graceful-timeout, once the
+	// remaining connections are closed.
+	timeoutCh := make(chan struct{})
+	var gracefulTimer *time.Timer
+	if *gracefulTimeoutFlag > 0 {
+		// Nothing that follows, including stuck connections, may hold up
+		// the exit for longer than this.
+		gracefulTimer = time.AfterFunc(*gracefulTimeoutFlag, func() {
+			log.Printf("[WARN] shutdown took longer than %s, closing remaining connections", *gracefulTimeoutFlag)
+			if accessLog.inFlight != nil {
+				logInFlight(accessLog.inFlight, "when connections were closed")
+			}
+			server.Close()
+			if adminServer != nil {
+				adminServer.Close()
+			}
+			close(timeoutCh)
+		})
+	}
+
+	close(heartbeatStopCh)
+	<-heartbeatDoneCh
+	close(stdinStopCh)
+	<-stdinDoneCh
+
+	ready.draining.Store(true)
+	if tcpHealthLn != nil {
+		// Refuse TCP health checks from now on, like /ready reports draining.
+		tcpHealthLn.Close()
+	}
+	if *preShutdownDelayFlag > 0 {
+		log.Printf("[INFO] waiting %s before shutting down", *preShutdownDelayFlag)
+		select {
+		case <-clk.After(*preShutdownDelayFlag):
+		case <-timeoutCh:
+		}
+	}
+
+	if *preShutdownExecFlag != "" {
+		runPreShutdownExec(*preShutdownExecFlag, timeoutCh)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.Printf("[ERR] failed to shutdown server: %s", shutdownErr)
+	}
+
+	// The admin server goes last so health and metrics stay scrapeable for
+	// the whole time the public server is draining.
+	if adminServer != nil {
+		adminCtx, adminCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer adminCancel()
+
+		if err := adminServer.Shutdown(adminCtx); err != nil {
+			log.Printf("[ERR] failed to shutdown admin server: %s", err)
+			if shutdownErr == nil {
+				shutdownErr = err
+			}
+		}
+	}
+
+	if controlLn != nil {
+		// Closing removes the socket file.
+		controlLn.Close()
+	}
+
+	if asyncLog != nil {
+		asyncLog.Close()
+		if n := asyncLog.Dropped(); n > 0 {
+			log.Printf("[WARN] dropped %d access log lines due to a full buffer", n)
+		}
+	}
+
+	if gracefulTimer != nil && !gracefulTimer.Stop() {
+		// The timer fired, so wait for it to finish closing connections.
+		<-timeoutCh
+		return 1
+	}
+	if serveErr != nil {
+		return 1
+	}
+	return shutdownExitCode(shutdownErr)
+}
+
+// reportServeError passes err on through errCh unless an earlier error is
+// already waiting there.
+func reportServeError(errCh chan<- error, err error) {
+	select {
+	case errCh <- err:
+	default:
+	}
+}
+
+// validateListenAddr checks that addr is a syntactically valid host:port pair
+// so that obvious mistakes are reported before the server goroutine starts.
+func validateListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+
+	if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, " /?#[]") {
+		return fmt.Errorf("invalid host %q", host)
+	}
+
+	return nil
+}
+
+// contentSources returns the names of the flags that were given to choose
+// what the echo endpoint responds with.
+func contentSources() []string {
+	var sources []string
+	if *textFlag != "" {
+		sources = append(sources, "-text")
+	}
+	if *envFlag != "" {
+		sources = append(sources, "-env")
+	}
+	if len(responseFlags) > 0 {
+		sources = append(sources, "-response")
+	}
+	if *templateFileFlag != "" {
+		sources = append(sources, "-template-file")
+	}
+	if *stdinStreamFlag {
+		sources = append(sources, "-stdin-stream")
+	}
+	return sources
+}
+
+// sensitiveFlags are the flags whose values /config redacts.
+var sensitiveFlags = map[string]bool{
+	"drain-token": true,
+}
+
+// urlFlags are the flags holding URLs, whose userinfo /config redacts.
+var urlFlags = map[string]bool{
+	"depends-on":   true,
+	"proxy-target": true,
+	"syslog-addr":  true,
+}
+
+// redactUserinfo replaces any credentials in the URL v, leaving values that
+// aren't URLs with userinfo as they are.
+func redactUserinfo(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.User == nil {
+		return v
+	}
+	u.User = url.User("REDACTED")
+	return u.String()
+}
+
+// effectiveConfig returns the value of every flag, with sensitive ones that
+// are set, and credentials in URLs, redacted.
+func effectiveConfig() map[string]string {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if sensitiveFlags[f.Name] && v != "" {
+			v = "REDACTED"
+		}
+		if urlFlags[f.Name] {
+			if values, ok := f.Value.(*stringSliceFlag); ok {
+				redacted := make([]string, len(*values))
+				for i, u := range *values {
+					redacted[i] = redactUserinfo(u)
+				}
+				v = strings.Join(redacted, ",")
+			} else {
+				v = redactUserinfo(v)
+			}
+		}
+		config[f.Name] = v
+	})
+	return config
+}
+
+// httpConfig returns config as JSON.
+func httpConfig(config map[string]string, pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, config, pretty)
+	}
+}
+
+func getEnvStrOrDefault(k, d string) string {
+	if v, ok := os.LookupEnv(k); ok {
+		return v
+	}
+
+	return d
+}
+
+// echoOptions holds the settings that shape the echo handler's response.
+type echoOptions struct {
+	// queryParam, if set, names a query parameter whose value overrides the
+	// echoed text.
+	queryParam string
+
+	// transform, if set, is applied to the echoed text before writing.
+	transform func(string) string
+
+	// encoding is how the echoed text is encoded: raw, hex or base64.
+	encoding string
+
+	// prefix and suffix are written around the echoed text.
+	prefix string
+	suffix string
+
+	// responses, if set, replaces the configured text with one of these,
+	// chosen by hashing the value of the selectHeader request header.
+	responses    []string
+	selectHeader string
+
+	// size, if positive, replaces the text with pattern repeated and
+	// truncated to exactly size bytes. With repeatText the echoed text is
+	// repeated instead of pattern.
+	pattern    string
+	size       int
+	repeatText bool
+
+	// checksum, if set, names the algorithm used to advertise a digest of
+	// the body in the response headers.
+	checksum string
+
+	// status is the response status code. If statusBodies has an entry for
+	// it, that body replaces the echoed text.
+	status       int
+	statusBodies map[int]string
+
+	// statusWeights, if set, picks the status per request instead.
+	statusWeights *weightedStatuses
+
+	// statusHeader lets the X-Echo-Status request header override the
+	// status.
+	statusHeader bool
+
+	// crlf ends the lines of echoed text with CRLF rather than LF.
+	crlf bool
+
+	// prettyJSON indents JSON responses.
+	prettyJSON bool
+
+	// stdin supplies the text for the stdin kind, a line at a time.
+	stdin *liveLines
+
+	// requestInfo appends the request method and path on a line after the
+	// echoed text.
+	requestInfo bool
+}
+
+func httpEcho(v, kind string, opts echoOptions) http.HandlerFunc {
+	var sized []byte
+	if opts.size > 0 && !opts.repeatText {
+		sized = repeatToSize(opts.pattern, opts.size)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := echoStatus(opts, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		body := sized
+		if sb, ok := opts.statusBodies[status]; ok {
+			body = []byte(sb + "\n")
+		}
+		if body == nil {
+			text := echoText(v, kind, opts, r)
+			if opts.transform != nil {
+				text = opts.transform(text)
+			}
+			switch opts.encoding {
+			case "hex":
+				text = hex.EncodeToString([]byte(text))
+			case "base64":
+				text = base64.StdEncoding.EncodeToString([]byte(text))
+			}
+			if opts.size > 0 && text != "" {
+				body = repeatToSize(text, opts.size)
+			} else {
+				body = []byte(opts.prefix + text + opts.suffix + "\n")
+				if opts.requestInfo {
+					body = append(body, fmt.Sprintf("[%s %s]\n", r.Method, r.URL.Path)...)
+				}
+				body = normalizeLineEndings(body, opts.crlf)
+			}
+		}
+
+		if opts.checksum != "" {
+			setChecksumHeaders(w.Header(), opts.checksum, body)
+		}
+
+		// HTTP/1.0 clients can't take chunked responses, so spell out the
+		// length and that the connection ends with the response.
+		legacy := !r.ProtoAtLeast(1, 1)
+		if opts.size > 0 || legacy {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if legacy {
+			w.Header().Set("Connection", "close")
+		}
+		if w.Header().Get("Content-Type") == "" {
+			if opts.encoding == "raw" {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			} else {
+				w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+			}
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// echoStatus resolves the status code the echo responds to r with, from
+// -status, -status-weights or, when allowed, the X-Echo-Status header.
+func echoStatus(opts echoOptions, r *http.Request) (int, error) {
+	status := opts.status
+	if opts.statusWeights != nil {
+		status = opts.statusWeights.pick()
+	}
+	if v := r.Header.Get("X-Echo-Status"); opts.statusHeader && v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil || !validStatus(code) {
+			return 0, fmt.Errorf("X-Echo-Status: %q is not a valid status code", v)
+		}
+		status = code
+	}
+	return status, nil
+}
+
+// structuredEcho resolves the status and text of a JSON or XML echo
+// response, responding 400 and returning false if the status is invalid.
+// Like the plain text echo, a -status-body for the status replaces the text.
+func structuredEcho(w http.ResponseWriter, r *http.Request, v, kind string, opts echoOptions) (int, string, bool) {
+	status, err := echoStatus(opts, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, "", false
+	}
+	if sb, ok := opts.statusBodies[status]; ok {
+		return status, sb, true
+	}
+
+	text := echoText(v, kind, opts, r)
+	if opts.transform != nil {
+		text = opts.transform(text)
+	}
+	return status, text, true
+}
+
+// httpXML returns the echoed text wrapped in a simple XML document.
+func httpXML(v, kind string, opts echoOptions) http.HandlerFunc {
+	type document struct {
+		XMLName xml.Name `xml:"echo"`
+		Text    string   `xml:",chardata"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, text, ok := structuredEcho(w, r, v, kind, opts)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(status)
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(document{Text: text})
+		io.WriteString(w, "\n")
+	}
+}
+
+// httpJSONEcho returns the echoed text as a JSON object.
+func httpJSONEcho(v, kind string, opts echoOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, text, ok := structuredEcho(w, r, v, kind, opts)
+		if !ok {
+			return
+		}
+
+		writeJSON(w, status, map[string]string{"text": text}, opts.prettyJSON)
+	}
+}
+
+// negotiatedFormat picks json, xml or text for an Accept header by quality
+// value. Text wins ties, wildcards and headers that list none of them.
+func negotiatedFormat(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					weight = f
+				}
+			}
+		}
+
+		var format string
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			format = "json"
+		case "application/xml", "text/xml":
+			format = "xml"
+		case "text/plain", "text/*", "*/*":
+			format = "text"
+		default:
+			continue
+		}
+		if weight > q[format] {
+			q[format] = weight
+		}
+	}
+
+	switch {
+	case q["json"] > q["text"] && q["json"] >= q["xml"]:
+		return "json"
+	case q["xml"] > q["text"] && q["xml"] > q["json"]:
+		return "xml"
+	default:
+		return "text"
+	}
+}
+
+// withNegotiation serves the echo as JSON or XML when the Accept header
+// prefers them, and as plain text through h otherwise.
+func withNegotiation(jsonHandler, xmlHandler, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		switch negotiatedFormat(r.Header.Get("Accept")) {
+		case "json":
+			jsonHandler(w, r)
+		case "xml":
+			xmlHandler(w, r)
+		default:
+			h(w, r)
+		}
+	}
+}
+
+// validStatus reports whether code is a status code that can be sent as a
+// final response.
+func validStatus(code int) bool {
+	return code >= 200 && code <= 599
+}
+
+// parseStatusBodies parses code=body pairs into a map keyed by status code.
+func parseStatusBodies(pairs []string) (map[int]string, error) {
+	bodies := make(map[int]string, len(pairs))
+	for _, p := range pairs {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not in code=body form", p)
+		}
+
+		code, err := strconv.Atoi(k)
+		if err != nil || !validStatus(code) {
+			return nil, fmt.Errorf("%q is not a valid status code", k)
+		}
+		bodies[code] = v
+	}
+	return bodies, nil
+}
+
+// parsePathDelays parses prefix=duration pairs into a map keyed by path
+// prefix.
+func parsePathDelays(pairs []string) (map[string]time.Duration, error) {
+	delays := make(map[string]time.Duration, len(pairs))
+	for _, p := range pairs {
+		prefix, v, ok := strings.Cut(p, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%q is not in /prefix=duration form", p)
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("%q is not a valid duration", v)
+		}
+		delays[prefix] = d
+	}
+	return delays, nil
+}
+
+// checksumHashes maps the supported -checksum algorithms to their hashes.
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// setChecksumHeaders sets X-Content-Checksum to the hex digest of body using
+// algo, plus the base64 Content-MD5 header when algo is md5.
+func setChecksumHeaders(h http.Header, algo string, body []byte) {
+	hh := checksumHashes[algo]()
+	hh.Write(body)
+	sum := hh.Sum(nil)
+
+	h.Set("X-Content-Checksum", hex.EncodeToString(sum))
+	if algo == "md5" {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	}
+}
+
+// echoText resolves the text the echo handler responds with for r.
+func echoText(v, kind string, opts echoOptions, r *http.Request) string {
+	if opts.queryParam != "" {
+		if q := r.URL.Query(); q.Has(opts.queryParam) {
+			return q.Get(opts.queryParam)
+		}
+	}
+
+	if len(opts.responses) > 0 {
+		return selectResponse(opts.responses, r.Header.Get(opts.selectHeader))
+	}
+
+	switch kind {
+	case "text":
+		return v
+	case "stdin":
+		return opts.stdin.take()
+	case "env":
+		if strings.Contains(v, ",") {
+			return envLines(strings.Split(v, ","))
+		}
+		resolvedV, ok := os.LookupEnv(v)
+		if !ok {
+			return fmt.Sprintf("failed resolving env var '%s'", v)
+		}
+		return resolvedV
+	default:
+		panic("something went wrong, not cool!")
+	}
+}
+
+// envLines renders each of keys as a KEY=value line, with KEY=<unset> for
+// variables that aren't set.
+func envLines(keys []string) string {
+	var lines []string
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		v, ok := os.LookupEnv(k)
+		if !ok {
+			v = "<unset>"
+		}
+		lines = append(lines, k+"="+v)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// normalizeLineEndings rewrites every line ending in b as CRLF if crlf is set
+// and as LF otherwise.
+func normalizeLineEndings(b []byte, crlf bool) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	if crlf {
+		b = bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+	}
+	return b
+}
+
+// repeatToSize repeats pattern until it is exactly size bytes long, truncating
+// the final copy.
+func repeatToSize(pattern string, size int) []byte {
+	b := bytes.Repeat([]byte(pattern), size/len(pattern)+1)
+	return b[:size]
+}
+
+// selectResponse deterministically maps key to one of responses. An empty key
+// always selects the first response.
+func selectResponse(responses []string, key string) string {
+	if key == "" {
+		return responses[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return responses[h.Sum32()%uint32(len(responses))]
+}
+
+// parseTransform returns the text transform named by name, or nil for none.
+func parseTransform(name string) (func(string) string, error) {
+	switch name {
+	case "none":
+		return nil, nil
+	case "upper":
+		return strings.ToUpper, nil
+	case "lower":
+		return strings.ToLower, nil
+	default:
+		return nil, fmt.Errorf("unknown transform %q (must be upper, lower or none)", name)
+	}
+}
+
+// httpBytes returns n random bytes, where n is the final path segment, up to
+// max bytes.
+func httpBytes(max int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/bytes/"))
+		if err != nil || n < 0 {
+			http.Error(w, "invalid byte count", http.StatusBadRequest)
+			return
+		}
+		if n > max {
+			http.Error(w, fmt.Sprintf("byte count exceeds maximum of %d", max), http.StatusBadRequest)
+			return
+		}
+
+		b := make([]byte, n)
+		if _, err := crand.Read(b); err != nil {
+			http.Error(w, "failed generating random bytes", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		w.Write(b)
+	}
+}
+
+// httpStream returns n newline-delimited JSON objects holding an id and the
+// echoed text, where n is the final path segment, up to max objects. Each
+// object is flushed as it is written.
+func httpStream(v, kind string, opts echoOptions, max int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/stream/"))
+		if err != nil || n < 0 {
+			http.Error(w, "invalid object count", http.StatusBadRequest)
+			return
+		}
+		if n > max {
+			http.Error(w, fmt.Sprintf("object count exceeds maximum of %d", max), http.StatusBadRequest)
+			return
+		}
+
+		text := echoText(v, kind, opts, r)
+		if opts.transform != nil {
+			text = opts.transform(text)
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		for i := 0; i < n; i++ {
+			if r.Context().Err() != nil {
+				return
+			}
+
+			if err := enc.Encode(map[string]interface{}{"id": i, "text": text}); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// httpKeepalive holds a streaming response open, writing a newline heartbeat
+// every interval so intermediaries don't drop the connection as idle. The
+// stream ends when the client goes away, after the optional duration query
+// parameter, or once shutdownCh is closed.
+func httpKeepalive(c clock, interval time.Duration, shutdownCh <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var end <-chan time.Time
+		if v := r.URL.Query().Get("duration"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			end = c.After(d)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-shutdownCh:
+				return
+			case <-end:
+				return
+			case <-c.After(interval):
+			}
+
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// httpDrip streams numbytes bytes evenly spread over duration, flushing after
+// each byte so clients observe the data arrive gradually.
+func httpDrip(c clock, max int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		numBytes := 10
+		if v := q.Get("numbytes"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > max {
+				http.Error(w, fmt.Sprintf("numbytes must be between 1 and %d", max), http.StatusBadRequest)
+				return
+			}
+			numBytes = n
+		}
+
+		duration := 2 * time.Second
+		if v := q.Get("duration"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			duration = d
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(numBytes))
+		w.WriteHeader(http.StatusOK)
+
+		flusher, _ := w.(http.Flusher)
+		interval := duration / time.Duration(numBytes)
+
+		for i := 0; i < numBytes; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-c.After(interval):
+			}
+
+			w.Write([]byte("*"))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// httpCache serves h with Cache-Control set from the max-age query parameter,
+// or a 304 when the request is conditional. A positive jitter moves each
+// max-age up or down by a random amount of at most that many seconds, never
+// below zero, so caches don't all expire together.
+func httpCache(c clock, jitter int, rng *rand.Rand, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" || r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		maxAge := 60
+		if v := r.URL.Query().Get("max-age"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid max-age", http.StatusBadRequest)
+				return
+			}
+			maxAge = n
+		}
+		if jitter > 0 {
+			maxAge += rng.Intn(2*jitter+1) - jitter
+			if maxAge < 0 {
+				maxAge = 0
+			}
+		}
+
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+		w.Header().Set("Last-Modified", c.Now().UTC().Format(http.TimeFormat))
+		h(w, r)
+	}
+}
+
+// httpNoCache serves h with headers telling clients and proxies not to cache
+// the response.
+func httpNoCache(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Expires", "0")
+		h(w, r)
+	}
+}
+
+// httpIP returns the client's address as JSON.
+func httpIP(trustProxy, pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"origin": clientIP(r, trustProxy),
+		}, pretty)
+	}
+}
+
+// httpMethodEcho returns the request's method, path and protocol as JSON, as
+// seen after any proxies in between.
+func httpMethodEcho(pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"proto":  r.Proto,
+		}, pretty)
+	}
+}
+
+// httpUserAgent returns the client's User-Agent header as JSON.
+func httpUserAgent(pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"user-agent": r.UserAgent(),
+		}, pretty)
+	}
+}
+
+// httpCurl returns a curl command line that reproduces the received request.
+func httpCurl() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		args := []string{"curl", "-X", shellQuote(r.Method)}
+		names := make([]string, 0, len(r.Header))
+		for name := range r.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name == "Content-Length" {
+				continue
+			}
+			for _, v := range r.Header[name] {
+				args = append(args, "-H", shellQuote(name+": "+v))
+			}
+		}
+		if len(body) > 0 {
+			args = append(args, "--data-binary", shellQuote(string(body)))
+		}
+		args = append(args, shellQuote(scheme+"://"+r.Host+r.URL.RequestURI()))
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, strings.Join(args, " "))
+	}
+}
+
+// postMaxMemory is how much of a multipart form /post keeps in memory before
+// spilling uploaded files to disk.
+const postMaxMemory = 32 << 20
+
+// httpPost parses a url-encoded or multipart form and returns its values, the
+// query arguments and the names of any uploaded files as JSON. The body is
+// limited by -max-body like any other.
+func httpPost(pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// ParseMultipartForm drops ParseForm's error for bodies that aren't
+		// multipart, such as an over-limit url-encoded one, so parse those
+		// first.
+		err := r.ParseForm()
+		if err == nil {
+			if err = r.ParseMultipartForm(postMaxMemory); err == http.ErrNotMultipart {
+				err = nil
+			}
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, fmt.Sprintf("failed parsing form: %s", err), http.StatusBadRequest)
+			}
+			return
+		}
+
+		files := make(map[string][]string)
+		if r.MultipartForm != nil {
+			for field, headers := range r.MultipartForm.File {
+				for _, fh := range headers {
+					files[field] = append(files[field], fh.Filename)
+				}
+			}
+			defer r.MultipartForm.RemoveAll()
+		}
+
+		form := r.PostForm
+		if form == nil {
+			form = url.Values{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"args":  r.URL.Query(),
+			"form":  form,
+			"files": files,
+		}, pretty)
+	}
+}
+
+// httpPatch reflects the body of PATCH requests with the same content type, so
+// clients can confirm the method and body made it through any proxies. Other
+// methods get a 405.
+func httpPatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			w.Header().Set("Allow", http.MethodPatch)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		b, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// shellQuote quotes s for a POSIX shell, leaving it bare when it only holds
+// characters that are never special.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@%+,") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// httpCookies returns the request's cookies as JSON.
+func httpCookies(pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookies := make(map[string]string)
+		for _, c := range r.Cookies() {
+			cookies[c.Name] = c.Value
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cookies": cookies,
+		}, pretty)
+	}
+}
+
+// httpSetCookies sets a cookie for each query parameter and redirects to
+// /cookies under pathPrefix.
+func httpSetCookies(pathPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.URL.Query() {
+			http.SetCookie(w, &http.Cookie{
+				Name:  name,
+				Value: values[0],
+				Path:  "/",
+			})
+		}
+		http.Redirect(w, r, pathPrefix+"/cookies", http.StatusFound)
+	}
+}
+
+// httpDigest returns the SHA-256 digest of the request body as JSON.
+func httpDigest(pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+
+		sum := sha256.Sum256(body)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"algorithm": "sha256",
+			"digest":    hex.EncodeToString(sum[:]),
+			"length":    len(body),
+		}, pretty)
+	}
+}
+
+// httpRoute reports which pattern mux matches for the path and method given
+// in the query, defaulting to the root path and GET.
+func httpRoute(mux *http.ServeMux, pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		path := q.Get("path")
+		if path == "" {
+			path = "/"
+		}
+		method := q.Get("method")
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		u, err := url.Parse(path)
+		if err != nil || !strings.HasPrefix(u.Path, "/") {
+			http.Error(w, "path must be an absolute path", http.StatusBadRequest)
+			return
+		}
+
+		_, pattern := mux.Handler(&http.Request{Method: method, Host: r.Host, URL: u})
+		writeJSON(w, http.StatusOK, map[string]string{
+			"method":  method,
+			"path":    u.Path,
+			"pattern": pattern,
+		}, pretty)
+	}
+}
+
+// httpRouteValues reports the pattern that matched the request and the values
+// of its wildcards.
+func httpRouteValues(pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		values := make(map[string]string)
+		for _, name := range patternWildcards(r.Pattern) {
+			values[name] = r.PathValue(name)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"pattern": r.Pattern,
+			"values":  values,
+		}, pretty)
+	}
+}
+
+// patternWildcards returns the names of the wildcards in a ServeMux pattern.
+func patternWildcards(pattern string) []string {
+	// Drop the method and host, if any.
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		pattern = pattern[i:]
+	}
+	var names []string
+	for _, seg := range strings.Split(pattern, "/") {
+		if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") || seg == "{$}" {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(seg[1:len(seg)-1], "..."))
+	}
+	return names
+}
+
+// httpReset takes over the connection and closes it without a response. TCP
+// connections are closed with a reset rather than an orderly shutdown.
+func httpReset() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection can't be reset", http.StatusNotImplemented)
+			return
+		}
+
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			http.Error(w, "connection can't be reset", http.StatusNotImplemented)
+			return
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+	}
+}
+
+// httpTrailers echoes the request body, and then the request's trailers as
+// response trailers.
+func httpTrailers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Trailers are only filled in once the body has been read in full.
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+
+		// Declaring the trailers up front makes the response chunked, which
+		// is the only way they can be sent.
+		for name := range r.Trailer {
+			w.Header().Add("Trailer", name)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(body)
+		for name, values := range r.Trailer {
+			w.Header()[name] = values
+		}
+	}
+}
+
+// httpBasicAuth checks the request's Basic Auth credentials against the user
+// and password given in the path as /basic-auth/{user}/{pass}.
+func httpBasicAuth(pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wantUser, wantPass, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/basic-auth/"), "/")
+		if !ok || wantUser == "" || strings.Contains(wantPass, "/") {
+			http.Error(w, "expected /basic-auth/{user}/{pass}", http.StatusNotFound)
+			return
+		}
 
-	// Validation
-	if *textFlag == "" && *envFlag == "" {
-		fmt.Fprintln(stderrW, "Missing -text or -env option!")
-		os.Exit(127)
+		user, pass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="http-echo"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"authenticated": false,
+			}, pretty)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"authenticated": true,
+			"user":          user,
+		}, pretty)
 	}
+}
 
-	args := flag.Args()
-	if len(args) > 0 {
-		fmt.Fprintln(stderrW, "Too many arguments!")
-		os.Exit(127)
+// clientIP returns the address of the client that made r, without the port.
+// When trustProxy is set the first X-Forwarded-For entry takes precedence.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
 	}
 
-	var finalFlag string
-	var finalKind string
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-	if *textFlag != "" {
-		finalFlag = *textFlag
-		finalKind = "text"
-	} else {
-		finalFlag = *envFlag
-		finalKind = "env"
+// writeJSON writes v as the JSON response body with the given status,
+// indented if pretty is set.
+func writeJSON(w http.ResponseWriter, status int, v interface{}, pretty bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
 	}
+	enc.Encode(v)
+}
 
-	// Flag gets printed as a page
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", httpLog(stdoutW, withAppHeaders(httpEcho(finalFlag, finalKind))))
+// defaultPage is echoed when no content option is given, unless -strict is
+// set.
+const defaultPage = `http-echo is running.
 
-	// Health endpoint
-	mux.HandleFunc("/health", withAppHeaders(httpHealth()))
+Choose what it responds with using -text, -env, -response, -size or
+-template-file. Run it with -help to see every option.`
 
-	server := &http.Server{
-		Addr:    *listenFlag,
-		Handler: mux,
+// defaultRobots is the robots.txt policy served when -robots is not set.
+const defaultRobots = "User-agent: *\nDisallow: /\n"
+
+// httpRobots serves the given robots.txt policy.
+func httpRobots(robots []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(robots)
 	}
-	serverCh := make(chan struct{})
-	go func() {
-		log.Printf("[INFO] server is listening on %s\n", *listenFlag)
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("[ERR] server exited with: %s", err)
+}
+
+// httpHealth responds with body as contentType until failAfter echo requests
+// have been served. A failAfter of 0 never fails.
+func httpHealth(body, contentType string, failAfter uint64, served *atomic.Uint64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if failAfter > 0 && served.Load() >= failAfter {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `{"status":"unhealthy"}`)
+			return
 		}
-		close(serverCh)
-	}()
+		w.Header().Set("Content-Type", contentType)
+		fmt.Fprintln(w, body)
+	}
+}
 
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
+// httpHealthDetail responds with the uptime, version and the state of each
+// configured check. Failed checks mark the server degraded but still respond
+// 200, since they say nothing about the process itself; only reaching
+// failAfter echo requests responds 503.
+func httpHealthDetail(rd *readiness, c clock, startedAt time.Time, failAfter uint64, served *atomic.Uint64, pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uptime := c.Now().Sub(startedAt)
+		status := "ok"
+		checks := make(map[string]interface{})
 
-	// Wait for interrupt
-	<-signalCh
+		if len(rd.deps) > 0 {
+			statuses, ok := checkDependencies(r.Context(), rd.deps)
+			if !ok {
+				status = "degraded"
+			}
+			checks["dependencies"] = statuses
+		}
+		if rd.file != "" {
+			if _, err := os.Stat(rd.file); err != nil {
+				status = "degraded"
+				checks["readiness_file"] = "missing"
+			} else {
+				checks["readiness_file"] = "ok"
+			}
+		}
+		if rd.draining.Load() {
+			checks["shutdown"] = "draining"
+		}
 
-	log.Printf("[INFO] received interrupt, shutting down...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+		code := http.StatusOK
+		if failAfter > 0 && served.Load() >= failAfter {
+			status = "unhealthy"
+			code = http.StatusServiceUnavailable
+		}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("[ERR] failed to shutdown server: %s", err)
+		writeJSON(w, code, map[string]interface{}{
+			"status":         status,
+			"version":        version,
+			"uptime":         uptime.Round(time.Second).String(),
+			"uptime_seconds": uptime.Seconds(),
+			"checks":         checks,
+		}, pretty)
 	}
+}
+
+const (
+	httpLogDateFormat string = "2006/01/02 15:04:05"
+	httpLogFormat     string = "%v %s %s \"%s %s %s\" %d %d \"%s\" %v"
+
+	// httpLogTLSFields is appended to httpLogFormat when TLS is enabled,
+	// holding the SNI server name and negotiated ALPN protocol.
+	httpLogTLSFields string = " \"%s\" \"%s\""
+
+	// httpLogTraceFields is appended to httpLogFormat for requests carrying a
+	// valid traceparent, holding its trace and parent span IDs.
+	httpLogTraceFields string = " trace_id=%s span_id=%s"
 
-	// If we got this far, it was an interrupt, so don't exit cleanly
-	os.Exit(2)
+	// httpLogBodyField is appended to httpLogFormat when -log-body is set,
+	// holding the quoted request body.
+	httpLogBodyField string = " body=%q"
+)
+
+// withAppHeaders adds application headers such as X-App-Version and X-App-Name.
+func withAppHeaders(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r)
+	}
 }
 
-func getEnvStrOrDefault(k, d string) string {
-	if v, ok := os.LookupEnv(k); ok {
-		return v
+// withMaxBody limits request bodies to limit bytes. Requests that declare a
+// larger body are rejected up front; otherwise reads past the limit fail.
+func withMaxBody(limit int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withRejectContinue declines uploads announced with Expect: 100-continue by
+// responding 417 before the body is sent. Without it, net/http sends the 100
+// Continue itself as soon as a handler reads the body.
+func withRejectContinue(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+			http.Error(w, http.StatusText(http.StatusExpectationFailed), http.StatusExpectationFailed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readBody reads the request body, responding with 413 or 400 and returning
+// false if it could not be read.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "failed reading request body", http.StatusBadRequest)
+		}
+		return nil, false
 	}
+	return b, true
+}
 
-	return d
+// withConcurrencyLimit allows at most limit concurrent calls to h. Excess
+// requests wait for a slot, or get a 503 straight away when reject is set.
+func withConcurrencyLimit(limit int, reject bool, h http.HandlerFunc) http.HandlerFunc {
+	sem := make(chan struct{}, limit)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reject {
+			select {
+			case sem <- struct{}{}:
+			default:
+				http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			select {
+			case sem <- struct{}{}:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		defer func() { <-sem }()
+
+		h(w, r)
+	}
 }
 
-func httpEcho(v, kind string) http.HandlerFunc {
+// withDelayHeader sleeps for the duration given in the X-Echo-Delay request
+// header, capped at max, before calling h. Unparseable or negative values are
+// ignored.
+func withDelayHeader(c clock, max time.Duration, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		switch kind {
-		case "text":
-			fmt.Fprintln(w, v)
-		case "env":
-			resolvedV, ok := os.LookupEnv(v)
-			if !ok {
-				fmt.Fprintln(w, fmt.Sprintf("failed resolving env var '%s'", v))
-			} else {
-				fmt.Fprintln(w, resolvedV)
+		if d, err := time.ParseDuration(r.Header.Get("X-Echo-Delay")); err == nil && d > 0 {
+			if d > max {
+				d = max
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-c.After(d):
 			}
-		default:
-			panic("something went wrong, not cool!")
 		}
+
+		h(w, r)
 	}
 }
 
-func httpHealth() http.HandlerFunc {
+// withPathDelay delays requests to h by the duration of the longest prefix in
+// delays that their path starts with.
+func withPathDelay(c clock, delays map[string]time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d time.Duration
+		longest := -1
+		for prefix, pd := range delays {
+			if len(prefix) > longest && strings.HasPrefix(r.URL.Path, prefix) {
+				d, longest = pd, len(prefix)
+			}
+		}
+
+		if d > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-c.After(d):
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withTrace answers TRACE requests by reflecting the received request line and
+// headers, and passes every other method through to h.
+func withTrace(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, `{"status":"ok"}`)
+		if r.Method != http.MethodTrace {
+			h(w, r)
+			return
+		}
+
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%s %s %s\r\n", r.Method, r.RequestURI, r.Proto)
+		fmt.Fprintf(&b, "Host: %s\r\n", r.Host)
+		r.Header.Write(&b)
+		b.WriteString("\r\n")
+
+		w.Header().Set("Content-Type", "message/http")
+		w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+		w.Write(b.Bytes())
 	}
 }
 
-const (
-	httpLogDateFormat string = "2006/01/02 15:04:05"
-	httpLogFormat     string = "%v %s %s \"%s %s %s\" %d %d \"%s\" %v\n"
-)
+// withNoIndex asks search engines not to index any response.
+func withNoIndex(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex")
+		h.ServeHTTP(w, r)
+	})
+}
 
-// withAppHeaders adds application headers such as X-App-Version and X-App-Name.
-func withAppHeaders(h http.HandlerFunc) http.HandlerFunc {
+// hopHeaders are the hop-by-hop headers defined by RFC 7230 section 6.1, which
+// are meaningful only for a single transport-level connection.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// streamingPaths are the endpoints that flush or hijack their responses. A
+// trailing slash matches the whole subtree.
+var streamingPaths = []string{"/drip", "/keepalive", "/stream/", "/reset", "/malformed"}
+
+// withStreamingBypass serves requests for streamingPaths under pathPrefix with
+// h, and every other request with buffered. It keeps middlewares that buffer
+// the whole response from breaking endpoints that can't be buffered.
+func withStreamingBypass(pathPrefix string, buffered, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreamingPath(pathPrefix, r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		buffered.ServeHTTP(w, r)
+	})
+}
+
+// isStreamingPath reports whether path is one of streamingPaths under
+// pathPrefix.
+func isStreamingPath(pathPrefix, path string) bool {
+	for _, p := range streamingPaths {
+		p = pathPrefix + p
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// orNotFound returns h if enabled is set, and http.NotFound otherwise. Optional
+// endpoints are registered either way, so that when disabled their paths 404
+// instead of falling through to the echo handler on "/".
+func orNotFound(enabled bool, h http.HandlerFunc) http.HandlerFunc {
+	if !enabled {
+		return http.NotFound
+	}
+	return h
+}
+
+// withRequestDeadline reports the deadline of the request's context, if it has
+// one, in the X-Request-Deadline response header.
+func withRequestDeadline(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deadline, ok := r.Context().Deadline(); ok {
+			w.Header().Set("X-Request-Deadline", deadline.UTC().Format(time.RFC3339Nano))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withRequestID echoes the request ID in the named header back on the
+// response, generating one from rng first when the request has none.
+func withRequestID(header string, rng *rand.Rand, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if id == "" {
+			id = randomHex(rng, 16)
+			r.Header.Set(header, id)
+		}
+		w.Header().Set(header, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withStripHopHeaders removes hop-by-hop headers, including any named in the
+// Connection header, from responses before they are written.
+func withStripHopHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var mrw metaResponseWriter
+		mrw.writer = w
+		mrw.beforeWriteHeader = func(hdr http.Header) {
+			for _, v := range hdr.Values("Connection") {
+				for _, name := range strings.Split(v, ",") {
+					hdr.Del(strings.TrimSpace(name))
+				}
+			}
+			for _, name := range hopHeaders {
+				hdr.Del(name)
+			}
+		}
+
+		h.ServeHTTP(&mrw, r)
+	})
+}
+
+// withRespondOnce closes doneCh once h has finished serving its first request.
+func withRespondOnce(doneCh chan<- struct{}, h http.HandlerFunc) http.HandlerFunc {
+	var once sync.Once
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r)
+		once.Do(func() { close(doneCh) })
+	}
+}
+
+// withRequestCount increments served for every request handled by h. With
+// countHeader set, the new total is reported in the X-Echo-Count header.
+func withRequestCount(served *atomic.Uint64, countHeader bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := served.Add(1)
+		if countHeader {
+			w.Header().Set("X-Echo-Count", strconv.FormatUint(n, 10))
+		}
+		h(w, r)
+	}
+}
+
+// withMaxRequests lets through the first max requests to h and responds 429
+// to every one after that.
+func withMaxRequests(max uint64, h http.HandlerFunc) http.HandlerFunc {
+	var count atomic.Uint64
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if count.Add(1) > max {
+			http.Error(w, fmt.Sprintf("request quota of %d exhausted", max), http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withStartupDelay responds with 503 until readyAt has passed, simulating a
+// slow-starting service.
+func withStartupDelay(c clock, readyAt time.Time, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.Now().Before(readyAt) {
+			http.Error(w, "service is starting", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withFlap alternates h between healthy and failing windows of the given
+// interval, starting healthy at start. During failing windows every request
+// gets a 503.
+func withFlap(c clock, start time.Time, interval time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.Now().Sub(start)/interval%2 == 1 {
+			http.Error(w, "service is flapping", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withEarlyHints sends a 103 Early Hints response carrying links as Link
+// headers before calling h. The links stay set on the final response.
+func withEarlyHints(links []string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, link := range links {
+			w.Header().Add("Link", link)
+		}
+		w.WriteHeader(http.StatusEarlyHints)
+		h(w, r)
+	}
+}
+
+// withServedBy sets X-Served-By to hostname and the local address the request
+// arrived on, before calling h.
+func withServedBy(hostname string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		servedBy := hostname
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			servedBy += " " + addr.String()
+		}
+		w.Header().Set("X-Served-By", servedBy)
+		h(w, r)
+	}
+}
+
+// withPanicRate makes h panic for the given fraction of requests.
+func withPanicRate(rate float64, rng *rand.Rand, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rng.Float64() < rate {
+			panic("simulated panic from -panic-rate")
+		}
+		h(w, r)
+	}
+}
+
+// withRecover converts panics in h into 500 responses and logs them, instead
+// of letting the server drop the connection.
+func withRecover(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("[ERR] panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+
 		h(w, r)
 	}
 }
 
+// withServerTiming sets a Server-Timing header reporting how long h took to
+// produce its response headers.
+func withServerTiming(c clock, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := c.Now()
+
+		var mrw metaResponseWriter
+		mrw.writer = w
+		mrw.beforeWriteHeader = func(hdr http.Header) {
+			dur := c.Now().Sub(start)
+			hdr.Set("Server-Timing", fmt.Sprintf("app;dur=%.3f", float64(dur)/float64(time.Millisecond)))
+		}
+
+		h(&mrw, r)
+	}
+}
+
+// withTimestamps sets X-Request-Received to when h was entered and
+// X-Response-Sent to just before the response headers are written.
+func withTimestamps(c clock, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		received := c.Now()
+
+		var mrw metaResponseWriter
+		mrw.writer = w
+		mrw.beforeWriteHeader = func(hdr http.Header) {
+			hdr.Set("X-Request-Received", received.UTC().Format(time.RFC3339Nano))
+			hdr.Set("X-Response-Sent", c.Now().UTC().Format(time.RFC3339Nano))
+		}
+
+		h(&mrw, r)
+	}
+}
+
+// statusReporter is implemented by response writers that record the response,
+// so handlers that write it to the hijacked connection themselves can still
+// have it logged.
+type statusReporter interface {
+	reportStatus(status, length int)
+}
+
 // metaResponseWriter is a response writer that saves information about the
 // response for logging.
 type metaResponseWriter struct {
 	writer http.ResponseWriter
 	status int
 	length int
+
+	// beforeWriteHeader, if set, is called with the response headers just
+	// before they are written, allowing last-minute modifications.
+	beforeWriteHeader func(http.Header)
 }
 
 // Header implements the http.ResponseWriter interface.
@@ -145,6 +2935,14 @@ func (w *metaResponseWriter) Header() http.Header {
 
 // WriteHeader implements the http.ResponseWriter interface.
 func (w *metaResponseWriter) WriteHeader(s int) {
+	if s < http.StatusOK && s != http.StatusSwitchingProtocols {
+		// Informational responses precede the real one.
+		w.writer.WriteHeader(s)
+		return
+	}
+	if w.status == 0 && w.beforeWriteHeader != nil {
+		w.beforeWriteHeader(w.writer.Header())
+	}
 	w.status = s
 	w.writer.WriteHeader(s)
 }
@@ -152,29 +2950,191 @@ func (w *metaResponseWriter) WriteHeader(s int) {
 // Write implements the http.ResponseWriter interface.
 func (w *metaResponseWriter) Write(b []byte) (int, error) {
 	if w.status == 0 {
-		w.status = http.StatusOK
+		w.WriteHeader(http.StatusOK)
 	}
-	w.length = len(b)
+	w.length += len(b)
 	return w.writer.Write(b)
 }
 
-// httpLog accepts an io object and logs the request and response objects to the
-// given io.Writer.
-func httpLog(out io.Writer, h http.HandlerFunc) http.HandlerFunc {
+// Flush implements the http.Flusher interface when the underlying writer
+// supports it.
+func (w *metaResponseWriter) Flush() {
+	if f, ok := w.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// reportStatus implements the statusReporter interface, passing the response
+// on to the underlying writer if it records responses too.
+func (w *metaResponseWriter) reportStatus(status, length int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.length += length
+	if sr, ok := w.writer.(statusReporter); ok {
+		sr.reportStatus(status, length)
+	}
+}
+
+// Hijack implements the http.Hijacker interface when the underlying writer
+// supports it, so protocol upgrades such as WebSockets pass through.
+func (w *metaResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.writer.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+// accessLogger holds the destination and options for access log lines.
+type accessLogger struct {
+	out io.Writer
+
+	// exclude holds path prefixes whose requests are neither logged nor
+	// recorded in latencies.
+	exclude []string
+
+	// slowThreshold, if positive, suppresses lines for requests that
+	// completed within it.
+	slowThreshold time.Duration
+
+	// latencies, if set, records the duration of every logged request.
+	latencies *latencyRing
+
+	// tlsFields adds the TLS server name and negotiated protocol to each
+	// line.
+	tlsFields bool
+
+	// clock timestamps and times each request.
+	clock clock
+
+	// utc writes timestamps in UTC rather than local time.
+	utc bool
+
+	// timeFormat is the layout of timestamps, or "unix" for seconds since the
+	// epoch.
+	timeFormat string
+
+	// logBody adds the request body to each line. JSON fields named in
+	// redactFields (lowercased) are redacted and other bodies are truncated
+	// to bodyMax bytes.
+	logBody      bool
+	redactFields map[string]bool
+	bodyMax      int
+
+	// color wraps status codes in ANSI color escapes.
+	color bool
+
+	// otel writes each line as a JSON span event with OpenTelemetry
+	// attribute names instead of the text format.
+	otel bool
+
+	// inFlight, if set, tracks the requests currently being logged.
+	inFlight *inFlightSet
+}
+
+// timestamp formats t as configured by timeFormat.
+func (l *accessLogger) timestamp(t time.Time) string {
+	if l.timeFormat == "unix" {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return t.Format(l.timeFormat)
+}
+
+// logTimeFormat resolves a -log-time-format name to the layout used by
+// accessLogger. Anything that isn't a known name is taken as a layout.
+func logTimeFormat(name string) string {
+	switch name {
+	case "default":
+		return httpLogDateFormat
+	case "rfc3339":
+		return time.RFC3339
+	case "rfc3339nano":
+		return time.RFC3339Nano
+	default:
+		return name
+	}
+}
+
+// httpLog accepts an access logger and logs the request and response objects
+// to its io.Writer.
+func httpLog(l *accessLogger, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var mrw metaResponseWriter
 		mrw.writer = w
 
+		for _, prefix := range l.exclude {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				h(w, r)
+				return
+			}
+		}
+
+		if l.inFlight != nil {
+			l.inFlight.add(r)
+			defer l.inFlight.remove(r)
+		}
+
+		var body []byte
+		var truncated bool
+		if l.logBody {
+			limit := bodyBufferMax
+			if l.bodyMax > limit {
+				limit = l.bodyMax
+			}
+			body, truncated = bufferBody(r, limit)
+		}
+
 		defer func(start time.Time) {
 			status := mrw.status
 			length := mrw.length
-			end := time.Now()
+			end := l.clock.Now()
 			dur := end.Sub(start)
-			fmt.Fprintf(out, httpLogFormat,
-				end.Format(httpLogDateFormat),
+			if l.utc {
+				end = end.UTC()
+			}
+			if l.latencies != nil {
+				l.latencies.record(dur)
+			}
+			if l.slowThreshold > 0 && dur <= l.slowThreshold {
+				return
+			}
+			if l.otel {
+				var logged string
+				if l.logBody {
+					logged = loggedBody(r.Header.Get("Content-Type"), body, truncated, l.redactFields, l.bodyMax)
+				}
+				fmt.Fprintf(l.out, "%s\n", otelLogLine(l.timestamp(end), r, status, length, dur, l.tlsFields, logged))
+				return
+			}
+			var statusArg interface{} = status
+			if l.color {
+				statusArg = colorStatus(status)
+			}
+			format := httpLogFormat
+			args := []interface{}{
+				l.timestamp(end),
 				r.Host, r.RemoteAddr, r.Method, r.URL.Path, r.Proto,
-				status, length, r.UserAgent(), dur)
-		}(time.Now())
+				statusArg, length, r.UserAgent(), dur,
+			}
+			if l.tlsFields {
+				var serverName, proto string
+				if r.TLS != nil {
+					serverName, proto = r.TLS.ServerName, r.TLS.NegotiatedProtocol
+				}
+				format += httpLogTLSFields
+				args = append(args, serverName, proto)
+			}
+			if traceID, spanID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+				format += httpLogTraceFields
+				args = append(args, traceID, spanID)
+			}
+			if l.logBody {
+				format += httpLogBodyField
+				args = append(args, loggedBody(r.Header.Get("Content-Type"), body, truncated, l.redactFields, l.bodyMax))
+			}
+			fmt.Fprintf(l.out, format+"\n", args...)
+		}(l.clock.Now())
 
 		h(&mrw, r)
 	}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// malformation is a deliberately broken HTTP response.
+type malformation struct {
+	name string
+	raw  string
+}
+
+// malformations are the responses /malformed cycles through.
+var malformations = []malformation{
+	{"bad-status-line", "HTTP/1.1 abc OK\r\nContent-Length: 0\r\n\r\n"},
+	{"bad-chunk-size", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n"},
+	{"short-chunk", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nhello"},
+	{"bad-header", "HTTP/1.1 200 OK\r\nNo colon here\r\nContent-Length: 0\r\n\r\n"},
+	{"conflicting-length", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 10\r\n\r\nhello"},
+	{"garbage", "\x00\x01\x02 this is not HTTP\r\n\r\n"},
+}
+
+// httpMalformed writes a malformed response to the hijacked connection and
+// closes it. The kind query parameter picks a malformation by name; otherwise
+// each request gets the next one in turn.
+func httpMalformed() http.HandlerFunc {
+	var next atomic.Uint64
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var m malformation
+		if kind := r.URL.Query().Get("kind"); kind != "" {
+			var names []string
+			for _, candidate := range malformations {
+				if candidate.name == kind {
+					m = candidate
+				}
+				names = append(names, candidate.name)
+			}
+			if m.name == "" {
+				http.Error(w, fmt.Sprintf("unknown kind %q (must be one of %s)", kind, strings.Join(names, ", ")), http.StatusBadRequest)
+				return
+			}
+		} else {
+			m = malformations[(next.Add(1)-1)%uint64(len(malformations))]
+		}
+
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "malformed responses need an HTTP/1.x connection", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		conn, bufrw, err := hj.Hijack()
+		if err == http.ErrNotSupported {
+			http.Error(w, "malformed responses need an HTTP/1.x connection", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		if err != nil {
+			log.Printf("[ERR] failed to hijack connection for a malformed response: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		bufrw.WriteString(m.raw)
+		if err := bufrw.Flush(); err != nil {
+			log.Printf("[ERR] failed to write %s response: %s", m.name, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMalformed(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-fuzz-responses")
+	// A fresh connection for each, as every malformed response ends one.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	for _, m := range malformations {
+		t.Run(m.name, func(t *testing.T) {
+			resp, err := client.Get(s.url + "/malformed?kind=" + m.name)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if err == nil {
+				t.Errorf("client read the %s response without an error", m.name)
+			}
+		})
+	}
+
+	// Without a kind, requests cycle through the malformations in turn.
+	for range malformations {
+		resp, err := client.Get(s.url + "/malformed")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil {
+			t.Error("client read a /malformed response without an error")
+		}
+	}
+
+	if resp, _ := s.get(t, "/malformed?kind=nope"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown kind = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestMalformedWithoutHijack(t *testing.T) {
+	rec := httptest.NewRecorder()
+	httpMalformed()(rec, httptest.NewRequest(http.MethodGet, "/malformed", nil))
+	if rec.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("status = %d, want 505", rec.Code)
+	}
+}
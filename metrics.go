@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricsNamespaceRe matches valid Prometheus metric name prefixes.
+var metricsNamespaceRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateMetricsNamespace returns an error if ns cannot be used as a
+// Prometheus metric name prefix.
+func validateMetricsNamespace(ns string) error {
+	if !metricsNamespaceRe.MatchString(ns) {
+		return fmt.Errorf("%q is not a valid Prometheus identifier", ns)
+	}
+	return nil
+}
+
+// metrics is a minimal collector exposed in the Prometheus text format. It
+// keeps only what the echo server needs, so there is no dependency on the
+// Prometheus client library.
+type metrics struct {
+	namespace string
+
+	mu        sync.Mutex
+	requests  map[int]uint64
+	durations float64
+	count     uint64
+	inFlight  int64
+	shutdowns uint64
+}
+
+func newMetrics(namespace string) *metrics {
+	return &metrics{
+		namespace: namespace,
+		requests:  make(map[int]uint64),
+	}
+}
+
+// observe records a completed request that was started with begin.
+func (m *metrics) observe(status int, dur time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight--
+	m.requests[status]++
+	m.durations += dur.Seconds()
+	m.count++
+}
+
+// begin records the start of a request.
+func (m *metrics) begin() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight++
+}
+
+// shutdownStarted records the start of a graceful shutdown.
+func (m *metrics) shutdownStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shutdowns++
+}
+
+// withMetrics records the status and, as measured by c, the duration of each
+// request handled by h.
+func withMetrics(c clock, m *metrics, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mrw metaResponseWriter
+		mrw.writer = w
+
+		defer func(start time.Time) {
+			status := mrw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			m.observe(status, c.Now().Sub(start))
+		}(c.Now())
+		m.begin()
+
+		h(&mrw, r)
+	}
+}
+
+// httpMetrics writes the collected metrics in the Prometheus text format.
+func httpMetrics(m *metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		name := m.namespace + "_requests_total"
+		fmt.Fprintf(w, "# HELP %s Total number of echo requests by status code.\n", name)
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+		codes := make([]int, 0, len(m.requests))
+		for code := range m.requests {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "%s{code=\"%d\"} %d\n", name, code, m.requests[code])
+		}
+
+		name = m.namespace + "_request_duration_seconds"
+		fmt.Fprintf(w, "# HELP %s Time spent serving echo requests.\n", name)
+		fmt.Fprintf(w, "# TYPE %s summary\n", name)
+		fmt.Fprintf(w, "%s_sum %g\n", name, m.durations)
+		fmt.Fprintf(w, "%s_count %d\n", name, m.count)
+
+		name = m.namespace + "_in_flight_requests"
+		fmt.Fprintf(w, "# HELP %s Number of echo requests currently being served.\n", name)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		fmt.Fprintf(w, "%s %d\n", name, m.inFlight)
+
+		name = m.namespace + "_shutdowns_total"
+		fmt.Fprintf(w, "# HELP %s Total number of graceful shutdowns initiated.\n", name)
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		fmt.Fprintf(w, "%s %d\n", name, m.shutdowns)
+	}
+}
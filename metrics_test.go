@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateMetricsNamespace(t *testing.T) {
+	cases := []struct {
+		ns string
+		ok bool
+	}{
+		{"http_echo", true},
+		{"_private", true},
+		{"Echo2", true},
+		{"", false},
+		{"2echo", false},
+		{"http-echo", false},
+		{"http.echo", false},
+	}
+
+	for _, tc := range cases {
+		err := validateMetricsNamespace(tc.ns)
+		if (err == nil) != tc.ok {
+			t.Errorf("validateMetricsNamespace(%q) = %v, want ok %t", tc.ns, err, tc.ok)
+		}
+	}
+}
+
+func TestMetricsNamespace(t *testing.T) {
+	for _, ns := range []string{"http_echo", "custom"} {
+		m := newMetrics(ns)
+		withMetrics(realClock{}, m, func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		rec := httptest.NewRecorder()
+		httpMetrics(m)(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+			name := strings.Fields(strings.TrimPrefix(strings.TrimPrefix(line, "# HELP "), "# TYPE "))[0]
+			if !strings.HasPrefix(name, ns+"_") {
+				t.Errorf("metric %q is not in namespace %q", name, ns)
+			}
+		}
+		if want := ns + `_requests_total{code="200"} 1`; !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics output is missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestMetricsDuration(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	m := newMetrics("http_echo")
+	h := withMetrics(c, m, func(w http.ResponseWriter, r *http.Request) {
+		c.Advance(1500 * time.Millisecond)
+	})
+	for i := 0; i < 2; i++ {
+		h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	rec := httptest.NewRecorder()
+	httpMetrics(m)(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"http_echo_request_duration_seconds_sum 3\n", "http_echo_request_duration_seconds_count 2\n"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics output is missing %q:\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestMetricsInFlightAndShutdowns(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-allow-delay-header", "-preshutdown-delay", "1s")
+
+	// waitFor polls /metrics until it reports metric as value.
+	waitFor := func(metric string, value int) {
+		t.Helper()
+		want := fmt.Sprintf("%s %d\n", metric, value)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, body := s.get(t, "/metrics")
+			if strings.Contains(body, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("/metrics never reported %q:\n%s", strings.TrimSpace(want), body)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("http_echo_in_flight_requests", 0)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		req, _ := http.NewRequest(http.MethodGet, s.url+"/", nil)
+		req.Header.Set("X-Echo-Delay", "500ms")
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor("http_echo_in_flight_requests", 1)
+	<-doneCh
+	waitFor("http_echo_in_flight_requests", 0)
+
+	waitFor("http_echo_shutdowns_total", 0)
+	// /metrics is still served during -preshutdown-delay.
+	s.cancel()
+	waitFor("http_echo_shutdowns_total", 1)
+}
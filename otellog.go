@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// otelLogLine renders a served request as a JSON span event whose attributes
+// follow the OpenTelemetry HTTP semantic conventions.
+func otelLogLine(ts string, r *http.Request, status, length int, dur time.Duration, tlsFields bool, body string) []byte {
+	attrs := map[string]interface{}{
+		"http.request.method":          r.Method,
+		"url.path":                     r.URL.Path,
+		"server.address":               r.Host,
+		"network.protocol.name":        "http",
+		"network.protocol.version":     protocolVersion(r),
+		"http.response.status_code":    status,
+		"http.response.body.size":      length,
+		"http.server.request.duration": dur.Seconds(),
+	}
+	if r.URL.RawQuery != "" {
+		attrs["url.query"] = r.URL.RawQuery
+	}
+	if ua := r.UserAgent(); ua != "" {
+		attrs["user_agent.original"] = ua
+	}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		attrs["client.address"] = host
+		if p, err := strconv.Atoi(port); err == nil {
+			attrs["client.port"] = p
+		}
+	} else {
+		attrs["client.address"] = r.RemoteAddr
+	}
+	if tlsFields && r.TLS != nil {
+		attrs["tls.client.server_name"] = r.TLS.ServerName
+		attrs["tls.next_protocol"] = r.TLS.NegotiatedProtocol
+	}
+	if body != "" {
+		attrs["http.request.body.content"] = body
+	}
+
+	event := map[string]interface{}{
+		"name":       "http.server.request",
+		"timestamp":  ts,
+		"attributes": attrs,
+	}
+	if traceID, spanID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		event["trace_id"] = traceID
+		event["span_id"] = spanID
+	}
+
+	// Only unencodable values can fail, and there are none here.
+	b, _ := json.Marshal(event)
+	return b
+}
+
+// protocolVersion returns the HTTP version of r as OpenTelemetry spells it,
+// such as "1.1" or "2".
+func protocolVersion(r *http.Request) string {
+	if r.ProtoMajor >= 2 && r.ProtoMinor == 0 {
+		return strconv.Itoa(r.ProtoMajor)
+	}
+	return strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestOTelLogFormat(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-log-format", "otel")
+
+	req, err := http.NewRequest(http.MethodGet, s.url+"/otel?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "otel-test")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	s.stop(t)
+
+	lines := s.accessLogLines(t)
+	var event struct {
+		Name       string                 `json:"name"`
+		Timestamp  string                 `json:"timestamp"`
+		TraceID    string                 `json:"trace_id"`
+		SpanID     string                 `json:"span_id"`
+		Attributes map[string]interface{} `json:"attributes"`
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &event); err != nil {
+		t.Fatalf("access log line is not JSON: %s\n%s", err, lines[len(lines)-1])
+	}
+
+	if event.Name != "http.server.request" || event.Timestamp == "" {
+		t.Errorf("event name %q, timestamp %q", event.Name, event.Timestamp)
+	}
+	if event.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || event.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("trace_id %q, span_id %q; want the traceparent's", event.TraceID, event.SpanID)
+	}
+
+	want := map[string]interface{}{
+		"http.request.method":       "GET",
+		"url.path":                  "/otel",
+		"url.query":                 "x=1",
+		"server.address":            s.addr,
+		"network.protocol.name":     "http",
+		"network.protocol.version":  "1.1",
+		"http.response.status_code": float64(http.StatusOK),
+		"http.response.body.size":   float64(len("hi\n")),
+		"user_agent.original":       "otel-test",
+		"client.address":            "127.0.0.1",
+	}
+	for key, value := range want {
+		if got := event.Attributes[key]; got != value {
+			t.Errorf("attribute %s = %v, want %v", key, got, value)
+		}
+	}
+	if _, ok := event.Attributes["http.server.request.duration"].(float64); !ok {
+		t.Errorf("attribute http.server.request.duration = %v, want a number", event.Attributes["http.server.request.duration"])
+	}
+	if port, ok := event.Attributes["client.port"].(float64); !ok || port <= 0 {
+		t.Errorf("attribute client.port = %v, want a port number", event.Attributes["client.port"])
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	for _, tc := range []struct {
+		major, minor int
+		want         string
+	}{
+		{1, 0, "1.0"},
+		{1, 1, "1.1"},
+		{2, 0, "2"},
+		{3, 0, "3"},
+	} {
+		r := &http.Request{ProtoMajor: tc.major, ProtoMinor: tc.minor}
+		if got := protocolVersion(r); got != tc.want {
+			t.Errorf("protocolVersion(HTTP/%d.%d) = %q, want %q", tc.major, tc.minor, got, tc.want)
+		}
+	}
+}
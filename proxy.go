@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// httpProxy forwards requests to target with prefix stripped from their
+// path, relaying the upstream response. Upstream failures get a 502.
+func httpProxy(target *url.URL, prefix string) http.HandlerFunc {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("[WARN] proxying %s to %s failed: %s", r.URL.Path, target, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Keep the leading slash so the path is joined onto the target's.
+		http.StripPrefix(strings.TrimSuffix(prefix, "/"), proxy).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	var gotPath, gotQuery, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotQuery = r.URL.Path, r.URL.RawQuery
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "from upstream")
+	}))
+	defer upstream.Close()
+
+	target, err := url.Parse(upstream.URL + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/proxy/items?id=7", strings.NewReader("sent"))
+	httpProxy(target, "/proxy/")(rec, req)
+
+	if gotPath != "/base/items" || gotQuery != "id=7" || gotBody != "sent" {
+		t.Errorf("upstream got %s?%s with body %q, want /base/items?id=7 with body %q", gotPath, gotQuery, gotBody, "sent")
+	}
+	if rec.Code != http.StatusTeapot || rec.Body.String() != "from upstream" || rec.Header().Get("X-Upstream") != "yes" {
+		t.Errorf("relayed %d %q %v, want the upstream's response", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	logs := captureLog(t)
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	rec := httptest.NewRecorder()
+	httpProxy(target, "/proxy/")(rec, httptest.NewRequest(http.MethodGet, "/proxy/x", nil))
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if !strings.Contains(logs.String(), "[WARN] proxying /x to "+upstream.URL+" failed") {
+		t.Errorf("logs = %q, want the failure logged", logs)
+	}
+}
+
+func TestProxyPrefixValidation(t *testing.T) {
+	cases := []struct {
+		prefix string
+		stderr string
+	}{
+		{"proxy/", "must start and end with /"},
+		{"/proxy", "must start and end with /"},
+		{"/{name}/", "must not contain { or }"},
+		{"/bytes/", `"/bytes/" is already an endpoint`},
+		{"/stream/", `"/stream/" is already an endpoint`},
+		{"/", `"/" is already an endpoint`},
+	}
+	for _, tc := range cases {
+		_, stderr, code := runMain(t, "-text", "hi", "-proxy-target", "http://127.0.0.1:1", "-proxy-prefix", tc.prefix)
+		if code != 127 || !strings.Contains(stderr, "Invalid -proxy-prefix: "+tc.stderr) {
+			t.Errorf("-proxy-prefix %q: exit %d, stderr %q", tc.prefix, code, stderr)
+		}
+	}
+
+	// A prefix beside an endpoint, rather than on it, is fine.
+	s := startServer(t, "-text", "hi", "-proxy-target", "http://127.0.0.1:1", "-proxy-prefix", "/health/")
+	if resp, _ := s.get(t, "/health"); resp.StatusCode != http.StatusOK {
+		t.Errorf("/health with -proxy-prefix /health/ = %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lockedSource is a rand.Source that is safe for concurrent use, so a single
+// seeded *rand.Rand can be shared across handlers.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+// Int63 implements the rand.Source interface.
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+// Seed implements the rand.Source interface.
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// newRand returns a concurrency-safe *rand.Rand seeded with seed.
+func newRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+// randomHex returns n random bytes from rng, hex encoded. Unlike rng.Read it
+// is safe to call concurrently, as it only draws through the locked source.
+func randomHex(rng *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := 0; i < n; i += 8 {
+		v := rng.Uint64()
+		for j := i; j < n && j < i+8; j++ {
+			b[j] = byte(v)
+			v >>= 8
+		}
+	}
+	return hex.EncodeToString(b)
+}
+
+// weightedStatuses picks status codes at random according to their weights.
+type weightedStatuses struct {
+	rng *rand.Rand
+
+	codes []int
+	// cumulative holds the running total of weights, aligned with codes.
+	cumulative []int
+}
+
+// parseStatusWeights parses a comma-separated list of code=weight pairs, such
+// as "200=80,500=15,503=5".
+func parseStatusWeights(s string, rng *rand.Rand) (*weightedStatuses, error) {
+	ws := &weightedStatuses{rng: rng}
+
+	total := 0
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not in code=weight form", pair)
+		}
+
+		code, err := strconv.Atoi(k)
+		if err != nil || !validStatus(code) {
+			return nil, fmt.Errorf("%q is not a valid status code", k)
+		}
+
+		weight, err := strconv.Atoi(v)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%q is not a valid weight", v)
+		}
+
+		total += weight
+		ws.codes = append(ws.codes, code)
+		ws.cumulative = append(ws.cumulative, total)
+	}
+
+	if total <= 0 {
+		return nil, fmt.Errorf("weights must sum to a positive number")
+	}
+
+	return ws, nil
+}
+
+// pick returns a status code chosen according to the configured weights.
+func (ws *weightedStatuses) pick() int {
+	n := ws.rng.Intn(ws.cumulative[len(ws.cumulative)-1])
+	i := sort.SearchInts(ws.cumulative, n+1)
+	return ws.codes[i]
+}
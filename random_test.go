@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatusWeights(t *testing.T) {
+	ws, err := parseStatusWeights("200=80,500=15,503=5", newRand(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpEcho("hi", "text", echoOptions{status: http.StatusOK, encoding: "raw", statusWeights: ws})
+
+	const n = 10000
+	counts := make(map[int]int)
+	for i := 0; i < n; i++ {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		counts[rec.Code]++
+	}
+
+	want := map[int]float64{200: 0.80, 500: 0.15, 503: 0.05}
+	for code, share := range want {
+		got := float64(counts[code]) / n
+		if math.Abs(got-share) > 0.02 {
+			t.Errorf("status %d share = %.3f, want about %.2f", code, got, share)
+		}
+	}
+	if len(counts) != len(want) {
+		t.Errorf("statuses = %v, want only %v", counts, want)
+	}
+}
+
+func TestParseStatusWeights(t *testing.T) {
+	cases := []struct {
+		in      string
+		wantErr bool
+	}{
+		{"200=1", false},
+		{"200=3, 404=1", false},
+		{"200=0,500=1", false},
+		{"200", true},
+		{"abc=1", true},
+		{"200=-1", true},
+		{"200=0,500=0", true},
+	}
+	for _, tc := range cases {
+		_, err := parseStatusWeights(tc.in, newRand(1))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseStatusWeights(%q) error = %v, want error: %t", tc.in, err, tc.wantErr)
+		}
+	}
+}
+
+func TestSeedReproducible(t *testing.T) {
+	sequence := func(seed string) []string {
+		s := startServer(t, "-text", "hi", "-seed", seed, "-status-weights", "200=50,500=30,503=20", "-generate-traceparent")
+		defer s.stop(t)
+
+		var seq []string
+		for i := 0; i < 20; i++ {
+			resp, _ := s.get(t, "/")
+			seq = append(seq, fmt.Sprintf("%d %s %s", resp.StatusCode, resp.Header.Get("X-Request-Id"), resp.Header.Get("traceparent")))
+		}
+		return seq
+	}
+
+	first, second := sequence("42"), sequence("42")
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("-seed 42 gave different sequences:\n%s\n%s", strings.Join(first, "\n"), strings.Join(second, "\n"))
+	}
+	if other := sequence("43"); reflect.DeepEqual(first, other) {
+		t.Error("-seed 42 and -seed 43 gave the same sequence")
+	}
+}
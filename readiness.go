@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readiness holds the conditions the /ready endpoint reports on.
+type readiness struct {
+	// readyAt is when the startup delay has elapsed.
+	readyAt time.Time
+
+	// deps must all be reachable for the server to be ready.
+	deps []*dependencyCheck
+
+	// file, if set, must exist for the server to be ready.
+	file string
+
+	// draining is set once shutdown has begun.
+	draining atomic.Bool
+}
+
+// httpReady reports the server as ready once the startup delay has passed,
+// all dependencies are reachable, the readiness file (if any) is present and
+// shutdown has not begun. With dependencies configured, the body lists the
+// status of each.
+func httpReady(rd *readiness, c clock, pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rd.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `{"status":"draining"}`)
+			return
+		}
+		if c.Now().Before(rd.readyAt) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, `{"status":"starting"}`)
+			return
+		}
+		if rd.file != "" {
+			if _, err := os.Stat(rd.file); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, `{"status":"readiness file missing"}`)
+				return
+			}
+		}
+		if len(rd.deps) > 0 {
+			statuses, ok := checkDependencies(r.Context(), rd.deps)
+			if !ok {
+				for url, status := range statuses {
+					if status != "ok" {
+						log.Printf("[WARN] dependency %s is unavailable: %s", url, status)
+					}
+				}
+				writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+					"status":       "dependency unavailable",
+					"dependencies": statuses,
+				}, pretty)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"status":       "ready",
+				"dependencies": statuses,
+			}, pretty)
+			return
+		}
+		fmt.Fprintln(w, `{"status":"ready"}`)
+	}
+}
+
+// httpDrain closes drainCh when POSTed the configured token, asking the
+// server to shut down gracefully. It responds 404 when no token is set so the
+// endpoint is indistinguishable from an unknown path.
+func httpDrain(token string, drainCh chan<- struct{}) http.HandlerFunc {
+	var once sync.Once
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		got := r.Header.Get("X-Drain-Token")
+		if got == "" {
+			got = r.FormValue("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		once.Do(func() { close(drainCh) })
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, `{"status":"draining"}`)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ready")
+	c := newFakeClock(time.Now())
+	h := httpReady(&readiness{file: file}, c, false)
+
+	check := func(status int, body string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		if rec.Code != status || !strings.Contains(rec.Body.String(), body) {
+			t.Errorf("/ready = %d %q, want %d with %q", rec.Code, rec.Body.String(), status, body)
+		}
+	}
+
+	check(http.StatusServiceUnavailable, "readiness file missing")
+
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusOK, "ready")
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusServiceUnavailable, "readiness file missing")
+}
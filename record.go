@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// recordedRequest is a request kept for /recorded.
+type recordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query,omitempty"`
+	Header http.Header `json:"headers"`
+	Body   string      `json:"body"`
+
+	// BodyTruncated is set when only the first bodyBufferMax bytes of the
+	// body were kept.
+	BodyTruncated bool `json:"body_truncated,omitempty"`
+}
+
+// requestRecorder keeps the most recent requests in a fixed-size ring buffer.
+type requestRecorder struct {
+	// clock timestamps recorded requests.
+	clock clock
+
+	// redact holds canonical header names whose values are replaced before
+	// requests are stored.
+	redact map[string]bool
+
+	mu   sync.Mutex
+	reqs []recordedRequest
+	next int
+	full bool
+}
+
+func newRequestRecorder(c clock, size int, redact []string) *requestRecorder {
+	rec := &requestRecorder{
+		clock:  c,
+		redact: make(map[string]bool, len(redact)),
+		reqs:   make([]recordedRequest, size),
+	}
+	for _, name := range redact {
+		rec.redact[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	return rec
+}
+
+// record adds req to the ring, overwriting the oldest entry when full.
+func (rec *requestRecorder) record(req recordedRequest) {
+	for name, values := range req.Header {
+		if rec.redact[name] {
+			redacted := make([]string, len(values))
+			for i := range redacted {
+				redacted[i] = "REDACTED"
+			}
+			req.Header[name] = redacted
+		}
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.reqs[rec.next] = req
+	rec.next++
+	if rec.next == len(rec.reqs) {
+		rec.next = 0
+		rec.full = true
+	}
+}
+
+// snapshot returns the recorded requests, oldest first.
+func (rec *requestRecorder) snapshot() []recordedRequest {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if !rec.full {
+		return append([]recordedRequest{}, rec.reqs[:rec.next]...)
+	}
+	return append(append([]recordedRequest{}, rec.reqs[rec.next:]...), rec.reqs[:rec.next]...)
+}
+
+// withRecord records every request to h in rec, apart from those for
+// /recorded itself. Up to bodyBufferMax bytes of the body are read up front
+// and the whole body is handed on to h unchanged.
+func withRecord(rec *requestRecorder, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/recorded" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, truncated := bufferBody(r, bodyBufferMax)
+		rec.record(recordedRequest{
+			Time:          rec.clock.Now(),
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Query:         r.URL.RawQuery,
+			Header:        r.Header.Clone(),
+			Body:          string(body),
+			BodyTruncated: truncated,
+		})
+		h.ServeHTTP(w, r)
+	})
+}
+
+// httpRecorded returns the recorded requests as JSON, oldest first.
+func httpRecorded(rec *requestRecorder, pretty bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, rec.snapshot(), pretty)
+	}
+}
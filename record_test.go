@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newFakeClock(start)
+	rec := newRequestRecorder(c, 2, []string{"authorization"})
+
+	var got []int
+	h := withRecord(rec, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/recorded" {
+			httpRecorded(rec, false)(w, r)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		got = append(got, len(b))
+	}))
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		c.Advance(time.Second)
+		return w
+	}
+
+	do(httptest.NewRequest(http.MethodGet, "/first", nil))
+	second := httptest.NewRequest(http.MethodPost, "/second?x=1", strings.NewReader("hello"))
+	second.Header.Set("Authorization", "Bearer secret")
+	do(second)
+	big := strings.Repeat("a", bodyBufferMax+10)
+	do(httptest.NewRequest(http.MethodPut, "/third", strings.NewReader(big)))
+
+	// The handler still gets every body in full.
+	if want := []int{0, 5, len(big)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handler read bodies of %v bytes, want %v", got, want)
+	}
+
+	w := do(httptest.NewRequest(http.MethodGet, "/recorded", nil))
+	var reqs []recordedRequest
+	if err := json.Unmarshal(w.Body.Bytes(), &reqs); err != nil {
+		t.Fatalf("decoding /recorded: %s\n%s", err, w.Body)
+	}
+	// With room for two, /first has been dropped and /recorded isn't kept.
+	if len(reqs) != 2 || reqs[0].Path != "/second" || reqs[1].Path != "/third" {
+		t.Fatalf("recorded %+v, want /second then /third", reqs)
+	}
+
+	r := reqs[0]
+	if r.Method != http.MethodPost || r.Query != "x=1" || r.Body != "hello" || r.BodyTruncated {
+		t.Errorf("recorded /second as %+v", r)
+	}
+	if !r.Time.Equal(start.Add(time.Second)) {
+		t.Errorf("/second recorded at %s, want %s", r.Time, start.Add(time.Second))
+	}
+	if auth := r.Header.Get("Authorization"); auth != "REDACTED" {
+		t.Errorf("recorded Authorization = %q, want REDACTED", auth)
+	}
+
+	r = reqs[1]
+	if !r.BodyTruncated || len(r.Body) != bodyBufferMax {
+		t.Errorf("recorded /third body of %d bytes, truncated=%t; want %d, true", len(r.Body), r.BodyTruncated, bodyBufferMax)
+	}
+}
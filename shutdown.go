@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout bounds how long each server may take to drain.
+const shutdownTimeout = 5 * time.Second
+
+// preShutdownExecTimeout bounds how long the -preshutdown-exec command may run
+// before it is killed and shutdown continues.
+const preShutdownExecTimeout = 10 * time.Second
+
+// shutdownExitCode returns the process exit code after a graceful shutdown
+// that finished with err: 0 when it was clean and 1 otherwise.
+func shutdownExitCode(err error) int {
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// runPreShutdownExec runs command through the shell, logging its combined
+// output. Failures are logged but never block shutdown, and the command is
+// killed early if cancelCh is closed.
+func runPreShutdownExec(command string, cancelCh <-chan struct{}) {
+	if strings.TrimSpace(command) == "" {
+		return
+	}
+	args := shellArgs(command)
+
+	ctx, cancel := context.WithTimeout(context.Background(), preShutdownExecTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-cancelCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	log.Printf("[INFO] running pre-shutdown command: %s", command)
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("[INFO] pre-shutdown command output:\n%s", out)
+	}
+	if err != nil {
+		log.Printf("[ERR] pre-shutdown command failed: %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreShutdownExec(t *testing.T) {
+	cases := []struct {
+		name    string
+		command string
+		want    []string
+	}{
+		{"success", "echo ran-before-shutdown", []string{"pre-shutdown command output:\nran-before-shutdown"}},
+		{"failure", "exit 3", []string{"[ERR] pre-shutdown command failed: exit status 3"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := startServer(t, "-text", "hi", "-preshutdown-exec", tc.command)
+			if strings.Contains(s.logs.String(), "running pre-shutdown command") {
+				t.Fatal("pre-shutdown command ran before shutdown")
+			}
+
+			// A failing command still lets shutdown finish cleanly.
+			if code := s.stop(t); code != 0 {
+				t.Errorf("exit code = %d, want 0", code)
+			}
+			logs := s.logs.String()
+			for _, want := range append([]string{"running pre-shutdown command: " + tc.command}, tc.want...) {
+				if !strings.Contains(logs, want) {
+					t.Errorf("logs = %q, want them to contain %q", logs, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownExitCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{context.DeadlineExceeded, 1},
+		{errors.New("admin server: use of closed network connection"), 1},
+	}
+	for _, tc := range cases {
+		if got := shutdownExitCode(tc.err); got != tc.want {
+			t.Errorf("shutdownExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+
+	// A shutdown with nothing in flight drains cleanly.
+	s := startServer(t, "-text", "hi")
+	s.get(t, "/")
+	if code := s.stop(t); code != 0 {
+		t.Errorf("exit code after a clean shutdown = %d, want 0", code)
+	}
+}
+
+func TestGracefulTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	type result struct {
+		stderr string
+		code   int
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		// Run through main, so the code is the one the process exits with.
+		_, stderr, code := runMain(t, "-text", "hi", "-listen", addr, "-respond-once", "-graceful-timeout", "300ms")
+		resultCh <- result{stderr, code}
+	}()
+
+	var stuck net.Conn
+	for i := 0; stuck == nil; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			stuck = conn
+		} else if i == 100 {
+			t.Fatalf("server never listened: %s", err)
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	defer stuck.Close()
+	// A request that never finishes its headers holds up the shutdown.
+	fmt.Fprintf(stuck, "GET / HTTP/1.1\r\nHost: %s\r\n", addr)
+
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	start := time.Now()
+
+	res := <-resultCh
+	if res.code != 1 {
+		t.Errorf("exit code = %d, want 1", res.code)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("exited %s after shutdown began, want about 300ms", elapsed)
+	}
+	if !strings.Contains(res.stderr, "shutdown took longer than 300ms, closing remaining connections") {
+		t.Errorf("stderr = %q, want the forced close logged", res.stderr)
+	}
+}
+
+func TestCancelContextShutsDown(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-allow-delay-header")
+
+	// A request in flight when the context is cancelled is allowed to finish.
+	type result struct {
+		body string
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, s.url+"/", nil)
+		req.Header.Set("X-Echo-Delay", "300ms")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		resultCh <- result{string(b), err}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, body := s.get(t, "/metrics"); strings.Contains(body, "http_echo_in_flight_requests 1\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request never went in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if code := s.stop(t); code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	if res := <-resultCh; res.err != nil || res.body != "hi\n" {
+		t.Errorf("in-flight request got %q, %v; want the echo", res.body, res.err)
+	}
+	if !strings.Contains(s.logs.String(), "[INFO] received shutdown signal, shutting down...") {
+		t.Errorf("logs = %q, want the shutdown logged", s.logs)
+	}
+	if _, err := http.Get(s.url + "/"); err == nil {
+		t.Error("server still serving after its context was cancelled")
+	}
+}
+
+func TestGracefulTimeoutReturns(t *testing.T) {
+	// An overrun returns from run rather than exiting, so it runs in this
+	// process; that the test goes on at all shows it didn't exit.
+	s := startServer(t, "-text", "hi", "-graceful-timeout", "300ms", "-preshutdown-delay", "10s")
+
+	start := time.Now()
+	if code := s.stop(t); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	// The timeout cuts the preshutdown delay short.
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("returned %s after shutdown began, want about 300ms", elapsed)
+	}
+	if !strings.Contains(s.logs.String(), "shutdown took longer than 300ms, closing remaining connections") {
+		t.Errorf("logs = %q, want the forced close logged", s.logs)
+	}
+}
+
+func TestStartupFailureReturns(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free := freeAddr(t)
+
+	logs := captureLog(t)
+	resetFlags(t, "-text", "hi", "-listen", free+","+busy.Addr().String())
+	if code := run(context.Background(), nil); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if !strings.Contains(logs.String(), "[ERR] failed to listen: ") {
+		t.Errorf("logs = %q, want the failed listen logged", logs)
+	}
+
+	// The listener opened before the failure was closed again.
+	ln, err := net.Listen("tcp", free)
+	if err != nil {
+		t.Fatalf("listening on %s after the failed start: %s", free, err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals returns the signals that trigger a graceful shutdown. SIGHUP
+// is left out when reload is set, as it reloads the -template-file instead.
+func shutdownSignals(reload bool) []os.Signal {
+	if reload {
+		return []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	return []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+}
+
+// reloadSignals returns the signals that reload the -template-file.
+func reloadSignals() []os.Signal {
+	return []os.Signal{syscall.SIGHUP}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestShutdownSignals(t *testing.T) {
+	cases := []struct {
+		reload bool
+		want   []os.Signal
+	}{
+		{false, []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}},
+		{true, []os.Signal{os.Interrupt, syscall.SIGTERM}},
+	}
+	for _, tc := range cases {
+		if got := shutdownSignals(tc.reload); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("shutdownSignals(%t) = %v, want %v", tc.reload, got, tc.want)
+		}
+	}
+
+	if got, want := reloadSignals(), []os.Signal{syscall.SIGHUP}; !reflect.DeepEqual(got, want) {
+		t.Errorf("reloadSignals() = %v, want %v", got, want)
+	}
+}
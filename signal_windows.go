@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// shutdownSignals returns the signals that trigger a graceful shutdown. Only
+// os.Interrupt is delivered on Windows.
+func shutdownSignals(reload bool) []os.Signal {
+	return []os.Signal{os.Interrupt}
+}
+
+// reloadSignals returns the signals that reload the -template-file. Windows
+// has none, so the template is only read at startup.
+func reloadSignals() []os.Signal {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestShutdownSignals(t *testing.T) {
+	for _, reload := range []bool{false, true} {
+		if got, want := shutdownSignals(reload), []os.Signal{os.Interrupt}; !reflect.DeepEqual(got, want) {
+			t.Errorf("shutdownSignals(%t) = %v, want %v", reload, got, want)
+		}
+	}
+
+	if got := reloadSignals(); len(got) != 0 {
+		t.Errorf("reloadSignals() = %v, want none", got)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"sync"
+)
+
+// stdinStreamMaxLines is the number of most recent stdin lines -stdin-stream
+// cycles through.
+const stdinStreamMaxLines = 1024
+
+// liveLines holds lines read so far and hands them out round-robin.
+type liveLines struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+// add appends line, dropping the oldest once there are more than
+// stdinStreamMaxLines.
+func (l *liveLines) add(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, line)
+	if len(l.lines) > stdinStreamMaxLines {
+		l.lines = l.lines[1:]
+	}
+}
+
+// take returns the next line in turn, or "" if none have been read yet.
+func (l *liveLines) take() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.lines) == 0 {
+		return ""
+	}
+	if l.next >= len(l.lines) {
+		l.next = 0
+	}
+	line := l.lines[l.next]
+	l.next++
+	return line
+}
+
+// readLines adds each line read from r to lines until r is exhausted or
+// stopCh is closed, then closes doneCh. A read blocked on stdin can't always
+// be interrupted, so on stop r is closed and the blocked read is abandoned
+// rather than waited for.
+func readLines(r io.ReadCloser, lines *liveLines, stopCh <-chan struct{}, doneCh chan<- struct{}) {
+	defer close(doneCh)
+
+	lineCh := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			select {
+			case lineCh <- scanner.Text():
+			case <-stopCh:
+				return
+			}
+		}
+		errCh <- scanner.Err()
+	}()
+
+	for {
+		select {
+		case <-stopCh:
+			r.Close()
+			return
+		case line := <-lineCh:
+			lines.add(line)
+		case err := <-errCh:
+			if err != nil {
+				log.Printf("[WARN] stopped reading stdin: %s", err)
+			} else {
+				log.Printf("[INFO] reached the end of stdin, still serving the lines read")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdinStream(t *testing.T) {
+	logs := captureLog(t)
+	lines := &liveLines{}
+	h := httpEcho("", "stdin", echoOptions{status: http.StatusOK, encoding: "raw", stdin: lines})
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Body.String()
+	}
+
+	if body := get(); body != "\n" {
+		t.Errorf("body before any line = %q, want an empty line", body)
+	}
+
+	r, w := io.Pipe()
+	stopCh, doneCh := make(chan struct{}), make(chan struct{})
+	go readLines(r, lines, stopCh, doneCh)
+
+	// Lines are served as they arrive, cycling through those read so far.
+	var read int
+	for _, tc := range []struct {
+		write string
+		want  []string
+	}{
+		{"one\n", []string{"one", "one"}},
+		{"two\nthree\n", []string{"two", "three", "one", "two"}},
+	} {
+		io.WriteString(w, tc.write)
+		read += strings.Count(tc.write, "\n")
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			lines.mu.Lock()
+			n := len(lines.lines)
+			lines.mu.Unlock()
+			if n == read || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		for i, line := range tc.want {
+			if body := get(); body != line+"\n" {
+				t.Errorf("after %q, request %d = %q, want %q", tc.write, i+1, body, line+"\n")
+			}
+		}
+	}
+
+	// Stopping doesn't wait on the blocked read.
+	close(stopCh)
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readLines still running after stop")
+	}
+	if _, err := io.WriteString(w, "four\n"); err == nil {
+		t.Error("stdin still open after stop")
+	}
+	if strings.Contains(logs.String(), "stdin") {
+		t.Errorf("logs = %q, want nothing logged on stop", logs)
+	}
+}
+
+func TestStdinStreamEOF(t *testing.T) {
+	logs := captureLog(t)
+	lines := &liveLines{}
+	doneCh := make(chan struct{})
+	go readLines(io.NopCloser(strings.NewReader("a\nb")), lines, make(chan struct{}), doneCh)
+	<-doneCh
+
+	for _, want := range []string{"a", "b", "a"} {
+		if got := lines.take(); got != want {
+			t.Errorf("take() = %q, want %q", got, want)
+		}
+	}
+	if !strings.Contains(logs.String(), "[INFO] reached the end of stdin") {
+		t.Errorf("logs = %q, want the end of stdin logged", logs)
+	}
+}
+
+func TestLiveLinesMax(t *testing.T) {
+	lines := &liveLines{}
+	for i := 0; i <= stdinStreamMaxLines; i++ {
+		lines.add(strings.Repeat("x", i))
+	}
+	// The first line added, "", was dropped to stay within the limit.
+	if len(lines.lines) != stdinStreamMaxLines || lines.take() != "x" {
+		t.Errorf("kept %d lines starting %q, want %d starting %q", len(lines.lines), lines.lines[0], stdinStreamMaxLines, "x")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// knownSyslogFacility accepts any name, as syslog is never connected to on
+// this platform.
+func knownSyslogFacility(name string) bool {
+	return true
+}
+
+// knownSyslogSeverity accepts any name, as syslog is never connected to on
+// this platform.
+func knownSyslogSeverity(name string) bool {
+	return true
+}
+
+// newSyslogWriter always fails, as log/syslog is not available on this
+// platform.
+func newSyslogWriter(addr, facility, severity string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
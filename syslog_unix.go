@@ -0,0 +1,64 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// syslogFacilities maps -syslog-facility names to their priorities.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogSeverities maps -syslog-severity names to their priorities.
+var syslogSeverities = map[string]syslog.Priority{
+	"emerg": syslog.LOG_EMERG, "alert": syslog.LOG_ALERT, "crit": syslog.LOG_CRIT,
+	"err": syslog.LOG_ERR, "warning": syslog.LOG_WARNING, "notice": syslog.LOG_NOTICE,
+	"info": syslog.LOG_INFO, "debug": syslog.LOG_DEBUG,
+}
+
+// knownSyslogFacility reports whether name is a -syslog-facility value.
+func knownSyslogFacility(name string) bool {
+	_, ok := syslogFacilities[name]
+	return ok
+}
+
+// knownSyslogSeverity reports whether name is a -syslog-severity value.
+func knownSyslogSeverity(name string) bool {
+	_, ok := syslogSeverities[name]
+	return ok
+}
+
+// newSyslogWriter connects to syslog at addr, or the local daemon if addr is
+// empty. A remote addr may be prefixed with its network, as in
+// tcp://host:514, and defaults to UDP.
+func newSyslogWriter(addr, facility, severity string) (io.Writer, error) {
+	f, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	s, ok := syslogSeverities[severity]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog severity %q", severity)
+	}
+
+	var network string
+	if addr != "" {
+		network = "udp"
+		if n, a, ok := strings.Cut(addr, "://"); ok {
+			network, addr = n, a
+		}
+	}
+
+	return syslog.Dial(network, addr, f|s, "http-echo")
+}
@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s := startServer(t, "-text", "hi", "-syslog", "-syslog-addr", "udp://"+pc.LocalAddr().String(),
+		"-syslog-facility", "local3", "-syslog-severity", "warning")
+	s.get(t, "/syslogged")
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no syslog message received: %s", err)
+	}
+	msg := string(buf[:n])
+
+	// local3 is facility 19 and warning severity 4: 19*8 + 4.
+	if !strings.HasPrefix(msg, "<156>") {
+		t.Errorf("message %q does not carry the local3.warning priority <156>", msg)
+	}
+	for _, want := range []string{"http-echo", "GET /syslogged"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q does not contain %q", msg, want)
+		}
+	}
+}
+
+func TestSyslogInvalidNames(t *testing.T) {
+	for _, args := range [][]string{
+		{"-syslog-facility", "local9"},
+		{"-syslog-severity", "loud"},
+	} {
+		_, stderr, code := runMain(t, append([]string{"-text", "hi", "-syslog"}, args...)...)
+		if code != 127 || !strings.Contains(stderr, "Invalid "+args[0]) {
+			t.Errorf("%v: exit code %d, stderr %q; want 127 and an invalid %s error", args, code, stderr, args[0])
+		}
+	}
+}
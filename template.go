@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// templateData is what a -template-file is rendered with for each request.
+type templateData struct {
+	Method     string
+	Host       string
+	Path       string
+	Proto      string
+	RemoteAddr string
+	Query      url.Values
+	Header     http.Header
+}
+
+// templatePage is an html/template parsed from a file, which can be reloaded
+// while requests are being served.
+type templatePage struct {
+	path string
+
+	mu   sync.RWMutex
+	tmpl *template.Template
+}
+
+// newTemplatePage parses the template in path.
+func newTemplatePage(path string) (*templatePage, error) {
+	p := &templatePage{path: path}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// load parses the template file again, keeping the previous template if that
+// fails.
+func (p *templatePage) load() error {
+	tmpl, err := template.New(filepath.Base(p.path)).ParseFiles(p.path)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.tmpl = tmpl
+	p.mu.Unlock()
+	return nil
+}
+
+// reloadOn reloads the template every time a value arrives on ch.
+func (p *templatePage) reloadOn(ch <-chan os.Signal) {
+	for range ch {
+		if err := p.load(); err != nil {
+			log.Printf("[ERR] failed to reload template, keeping the previous one: %s", err)
+			continue
+		}
+		log.Printf("[INFO] reloaded template from %s", p.path)
+	}
+}
+
+// httpTemplate renders p as an HTML page for each request.
+func httpTemplate(p *templatePage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.mu.RLock()
+		tmpl := p.tmpl
+		p.mu.RUnlock()
+
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, templateData{
+			Method:     r.Method,
+			Host:       r.Host,
+			Path:       r.URL.Path,
+			Proto:      r.Proto,
+			RemoteAddr: r.RemoteAddr,
+			Query:      r.URL.Query(),
+			Header:     r.Header,
+		})
+		if err != nil {
+			log.Printf("[ERR] failed to render template: %s", err)
+			http.Error(w, "failed rendering template", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(buf.Bytes())
+	}
+}
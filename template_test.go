@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "page.html")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`<p>{{.Method}} {{.Path}} q={{.Query.Get "q"}}</p>`)
+
+	p, err := newTemplatePage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpTemplate(p)
+	render := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, "/some/<path>?q=1", nil))
+		return rec
+	}
+
+	rec := render()
+	// The path is HTML escaped by html/template.
+	if want := "<p>GET /some/&lt;path&gt; q=1</p>"; rec.Body.String() != want {
+		t.Errorf("rendered %q, want %q", rec.Body.String(), want)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+
+	// A reload picks up changes, and a broken template keeps the last one.
+	write(`<p>v2 {{.Path}}</p>`)
+	if err := p.load(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<p>v2 /some/&lt;path&gt;</p>"; render().Body.String() != want {
+		t.Errorf("after reload rendered %q, want %q", render().Body.String(), want)
+	}
+	write(`<p>{{.Path</p>`)
+	if err := p.load(); err == nil {
+		t.Error("loading a broken template succeeded")
+	}
+	if want := "<p>v2 /some/&lt;path&gt;</p>"; render().Body.String() != want {
+		t.Errorf("after a failed reload rendered %q, want %q", render().Body.String(), want)
+	}
+}
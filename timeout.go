@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutWriter buffers a response until withTimeout decides whether it, or
+// the timeout response, is sent. Informational responses are passed straight
+// on to dst, as they can't be replayed later.
+type timeoutWriter struct {
+	dst    http.ResponseWriter
+	header http.Header
+
+	mu       sync.Mutex
+	status   int
+	body     bytes.Buffer
+	timedOut bool
+}
+
+// Header implements the http.ResponseWriter interface.
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *timeoutWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timedOut || w.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		for k, v := range w.header {
+			w.dst.Header()[k] = v
+		}
+		w.dst.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// withTimeout gives h d to respond, after which the client gets status and
+// body instead and further writes by h fail with http.ErrHandlerTimeout. Like
+// http.TimeoutHandler, the response is buffered until h returns, so main keeps
+// the streaming endpoints out of it with withStreamingBypass.
+func withTimeout(d time.Duration, status int, body string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{dst: w, header: make(http.Header)}
+		doneCh := make(chan struct{})
+		panicCh := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicCh <- p
+				}
+			}()
+			h.ServeHTTP(tw, r)
+			close(doneCh)
+		}()
+
+		select {
+		case p := <-panicCh:
+			panic(p)
+		case <-doneCh:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			dst := w.Header()
+			for k, v := range tw.header {
+				dst[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.body.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			tw.timedOut = true
+			if ctx.Err() == context.DeadlineExceeded {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(status)
+				fmt.Fprintln(w, body)
+			}
+		}
+	})
+}
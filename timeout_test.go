@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	t.Run("slow", func(t *testing.T) {
+		servedCh := make(chan struct{})
+		errCh := make(chan error, 1)
+		h := withTimeout(50*time.Millisecond, http.StatusGatewayTimeout, "too slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-servedCh
+			_, err := io.WriteString(w, "late")
+			errCh <- err
+		}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(servedCh)
+		if err := <-errCh; err != http.ErrHandlerTimeout {
+			t.Errorf("write after the timeout = %v, want http.ErrHandlerTimeout", err)
+		}
+
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("status = %d, want 504", rec.Code)
+		}
+		if rec.Body.String() != "too slow\n" {
+			t.Errorf("body = %q, want %q", rec.Body.String(), "too slow\n")
+		}
+	})
+
+	t.Run("fast", func(t *testing.T) {
+		h := withTimeout(time.Second, http.StatusGatewayTimeout, "too slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Handler", "yes")
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "done")
+		}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if rec.Code != http.StatusCreated || rec.Body.String() != "done" || rec.Header().Get("X-Handler") != "yes" {
+			t.Errorf("response = %d %q %v, want the handler's", rec.Code, rec.Body.String(), rec.Header())
+		}
+	})
+
+	t.Run("informational", func(t *testing.T) {
+		srv := httptest.NewServer(withTimeout(time.Second, http.StatusGatewayTimeout, "too slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+			io.WriteString(w, "final")
+		})))
+		defer srv.Close()
+
+		var early []int
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				early = append(early, code)
+				return nil
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if len(early) != 1 || early[0] != http.StatusEarlyHints {
+			t.Errorf("informational responses = %v, want [103]", early)
+		}
+		if resp.StatusCode != http.StatusOK || string(b) != "final" {
+			t.Errorf("final response = %d %q, want 200 %q", resp.StatusCode, b, "final")
+		}
+	})
+}
+
+func TestTimeoutStreamingBypass(t *testing.T) {
+	s := startServer(t, "-text", "hi", "-request-timeout", "100ms", "-timeout-status", "504", "-timeout-body", "gave up", "-allow-delay-header")
+
+	if resp, body := s.get(t, "/"); resp.StatusCode != http.StatusOK || body != "hi\n" {
+		t.Errorf("/ = %d %q, want 200 %q", resp.StatusCode, body, "hi\n")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Echo-Delay", "300ms")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout || string(b) != "gave up\n" {
+		t.Errorf("delayed / = %d %q, want 504 %q", resp.StatusCode, b, "gave up\n")
+	}
+
+	// Streaming endpoints are not held to the timeout.
+	if resp, body := s.get(t, "/drip?numbytes=3&duration=300ms"); resp.StatusCode != http.StatusOK || len(body) != 3 {
+		t.Errorf("/drip = %d %q, want 200 and 3 bytes", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// parseTLSVersion maps a -min-tls-version value to its crypto/tls constant.
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q (must be 1.2 or 1.3)", v)
+	}
+}
+
+// parseCipherSuites maps a comma-separated list of IANA cipher suite names to
+// their crypto/tls IDs. TLS 1.3 suites are not configurable in Go and are
+// always enabled.
+func parseCipherSuites(s string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadCertificates loads each cert/key pair, parsing the leaf so it can be
+// matched against SNI server names.
+func loadCertificates(certFiles, keyFiles []string) ([]tls.Certificate, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d certificates but %d keys", len(certFiles), len(keyFiles))
+	}
+
+	certs := make([]tls.Certificate, 0, len(certFiles))
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// sniCertificates selects a certificate by the SNI server name the client
+// asked for.
+type sniCertificates struct {
+	certs []tls.Certificate
+
+	// rejectUnknown fails the handshake when no certificate matches instead
+	// of falling back to the first one.
+	rejectUnknown bool
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (s *sniCertificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName != "" {
+		for i := range s.certs {
+			if s.certs[i].Leaf.VerifyHostname(hello.ServerName) == nil {
+				return &s.certs[i], nil
+			}
+		}
+	}
+
+	if s.rejectUnknown {
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+	return &s.certs[0], nil
+}
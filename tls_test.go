@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed ECDSA certificate for hosts, and its key, to
+// PEM files in a temporary directory and returns their paths.
+func writeCert(t *testing.T, hosts ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, hosts[0]+".crt"), filepath.Join(dir, hosts[0]+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsDial completes a TLS handshake with the server at addr using config.
+func tlsDial(addr string, config *tls.Config) (*tls.ConnectionState, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	return &state, nil
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	certFile, keyFile := writeCert(t, "localhost")
+
+	cases := []struct {
+		min       string
+		clientMax uint16
+		wantErr   bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.2", tls.VersionTLS13, false},
+		{"1.3", tls.VersionTLS12, true},
+		{"1.3", tls.VersionTLS13, false},
+	}
+	names := map[uint16]string{tls.VersionTLS12: "TLS 1.2", tls.VersionTLS13: "TLS 1.3"}
+	for _, tc := range cases {
+		s := startServer(t, "-text", "hi", "-tls-cert", certFile, "-tls-key", keyFile, "-min-tls-version", tc.min)
+		state, err := tlsDial(s.addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tc.clientMax})
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("-min-tls-version %s: handshake with a client capped at %s succeeded", tc.min, names[tc.clientMax])
+			}
+		} else if err != nil {
+			t.Errorf("-min-tls-version %s: handshake with a client capped at %s: %s", tc.min, names[tc.clientMax], err)
+		} else if state.Version != tc.clientMax {
+			t.Errorf("-min-tls-version %s: negotiated %s, want %s", tc.min, names[state.Version], names[tc.clientMax])
+		}
+		s.stop(t)
+	}
+
+	if _, err := parseTLSVersion("1.1"); err == nil {
+		t.Error("parseTLSVersion(\"1.1\") succeeded, want an error")
+	}
+}
+
+func TestTLSCiphers(t *testing.T) {
+	certFile, keyFile := writeCert(t, "localhost")
+	s := startServer(t, "-text", "hi", "-tls-cert", certFile, "-tls-key", keyFile,
+		"-tls-ciphers", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+
+	cases := []struct {
+		suite   uint16
+		wantErr bool
+	}{
+		{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, false},
+		{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, true},
+		{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, true},
+	}
+	for _, tc := range cases {
+		// Cipher suites only apply up to TLS 1.2.
+		state, err := tlsDial(s.addr, &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tc.suite},
+		})
+		name := tls.CipherSuiteName(tc.suite)
+		switch {
+		case tc.wantErr && err == nil:
+			t.Errorf("handshake offering only %s succeeded", name)
+		case !tc.wantErr && err != nil:
+			t.Errorf("handshake offering only %s: %s", name, err)
+		case !tc.wantErr && state.CipherSuite != tc.suite:
+			t.Errorf("negotiated %s, want %s", tls.CipherSuiteName(state.CipherSuite), name)
+		}
+	}
+
+	if _, err := parseCipherSuites("TLS_NOT_A_SUITE"); err == nil {
+		t.Error("parseCipherSuites with an unknown name succeeded, want an error")
+	}
+}
+
+func TestSNICertificates(t *testing.T) {
+	aCert, aKey := writeCert(t, "a.example.test")
+	bCert, bKey := writeCert(t, "b.example.test")
+
+	cases := []struct {
+		rejectUnknown bool
+		serverName    string
+		want          string // DNS name of the served certificate, or "" for a failed handshake
+	}{
+		{false, "a.example.test", "a.example.test"},
+		{false, "b.example.test", "b.example.test"},
+		{false, "other.example.test", "a.example.test"},
+		{true, "b.example.test", "b.example.test"},
+		{true, "other.example.test", ""},
+	}
+	for _, tc := range cases {
+		args := []string{"-text", "hi", "-tls-cert", aCert, "-tls-key", aKey, "-tls-cert", bCert, "-tls-key", bKey}
+		if tc.rejectUnknown {
+			args = append(args, "-tls-reject-unknown-sni")
+		}
+		s := startServer(t, args...)
+
+		state, err := tlsDial(s.addr, &tls.Config{InsecureSkipVerify: true, ServerName: tc.serverName})
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("reject unknown %t, SNI %s: handshake succeeded", tc.rejectUnknown, tc.serverName)
+		case tc.want != "" && err != nil:
+			t.Errorf("reject unknown %t, SNI %s: %s", tc.rejectUnknown, tc.serverName, err)
+		case tc.want != "" && state.PeerCertificates[0].DNSNames[0] != tc.want:
+			t.Errorf("reject unknown %t, SNI %s: served the certificate for %s, want %s",
+				tc.rejectUnknown, tc.serverName, state.PeerCertificates[0].DNSNames[0], tc.want)
+		}
+		s.stop(t)
+	}
+}
+
+func TestTLSLogFields(t *testing.T) {
+	certFile, keyFile := writeCert(t, "localhost")
+	s := startServer(t, "-text", "hi", "-tls-cert", certFile, "-tls-key", keyFile)
+
+	cases := []struct {
+		http2 bool
+		proto string
+	}{
+		{false, "http/1.1"},
+		{true, "h2"},
+	}
+	for _, tc := range cases {
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"},
+			ForceAttemptHTTP2: tc.http2,
+		}
+		if !tc.http2 {
+			transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + s.addr + "/" + tc.proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+	}
+
+	// Stopping waits for the requests' log lines to be written.
+	s.stop(t)
+	lines := s.accessLogLines(t)
+	if len(lines) != len(cases) {
+		t.Fatalf("access log = %q, want %d lines", lines, len(cases))
+	}
+	for i, tc := range cases {
+		if want := `"localhost" "` + tc.proto + `"`; !strings.HasSuffix(lines[i], want) {
+			t.Errorf("log line %q does not end with the TLS fields %s", lines[i], want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// parseTraceparent extracts the trace and parent span IDs from a W3C
+// traceparent header value, reporting whether it is well formed.
+func parseTraceparent(v string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" ||
+		!isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) ||
+		!isLowerHex(spanID, 16) || spanID == strings.Repeat("0", 16) ||
+		!isLowerHex(flags, 2) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+// isLowerHex reports whether s is n lowercase hex digits.
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceparent returns a sampled version 00 traceparent with IDs drawn from
+// rng.
+func newTraceparent(rng *rand.Rand) string {
+	return "00-" + randomHex(rng, 16) + "-" + randomHex(rng, 8) + "-01"
+}
+
+// withTraceparent echoes a valid incoming traceparent header back on the
+// response. When generate is set, requests without one are given a new
+// traceparent from rng first, so it is logged and echoed like a received one.
+func withTraceparent(generate bool, rng *rand.Rand, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp := r.Header.Get("traceparent")
+		if _, _, ok := parseTraceparent(tp); ok {
+			w.Header().Set("traceparent", tp)
+		} else if generate {
+			tp := newTraceparent(rng)
+			r.Header.Set("traceparent", tp)
+			w.Header().Set("traceparent", tp)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
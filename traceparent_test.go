@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	cases := []struct {
+		name      string
+		sent      string
+		generate  bool
+		reflected string // "" for none, "generated" for a new one
+		logged    string
+	}{
+		{"valid", valid, false, valid, " trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=00f067aa0ba902b7"},
+		{"uppercase", strings.ToUpper(valid), false, "", ""},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, "", ""},
+		{"missing", "", false, "", ""},
+		{"missing, generated", "", true, "generated", " trace_id="},
+		{"valid, not replaced", valid, true, valid, " trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=00f067aa0ba902b7"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			l := &accessLogger{out: &out, clock: newFakeClock(time.Now()), timeFormat: httpLogDateFormat}
+			h := withTraceparent(tc.generate, newRand(1), httpLog(l, func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.sent != "" {
+				req.Header.Set("traceparent", tc.sent)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get("traceparent")
+			switch tc.reflected {
+			case "generated":
+				if _, _, ok := parseTraceparent(got); !ok {
+					t.Errorf("traceparent = %q, want a generated valid one", got)
+				}
+			default:
+				if got != tc.reflected {
+					t.Errorf("traceparent = %q, want %q", got, tc.reflected)
+				}
+			}
+
+			line := strings.TrimSuffix(out.String(), "\n")
+			if tc.logged == "" && strings.Contains(line, "trace_id=") {
+				t.Errorf("log line %q has trace fields, want none", line)
+			}
+			if tc.logged != "" && !strings.Contains(line, tc.logged) {
+				t.Errorf("log line %q does not contain %q", line, tc.logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// withTruncate responds from h with a Content-Length extra bytes longer than
+// the body and then closes the connection, so clients see the response cut
+// short. The response is written to the hijacked connection, since net/http
+// won't send a body shorter than its declared length. Connections that can't
+// be hijacked, such as HTTP/2 ones or those behind a writer without Hijack
+// support, get the response in full.
+func withTruncate(c clock, extra int, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			h(w, r)
+			return
+		}
+
+		// Headers already set by outer handlers, such as X-Request-ID, are
+		// only on w, so start from a copy of them.
+		brw := &bufferedResponseWriter{header: w.Header().Clone()}
+		h(brw, r)
+		if brw.status == 0 {
+			brw.status = http.StatusOK
+		}
+
+		conn, bufrw, err := hj.Hijack()
+		if err == http.ErrNotSupported {
+			brw.writeTo(w)
+			return
+		}
+		if err != nil {
+			log.Printf("[ERR] failed to hijack connection for a truncated response: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		hdr := brw.header
+		hdr.Del("Transfer-Encoding")
+		hdr.Set("Connection", "close")
+		hdr.Set("Content-Length", strconv.Itoa(brw.body.Len()+extra))
+		if _, ok := hdr["Date"]; !ok {
+			hdr.Set("Date", c.Now().UTC().Format(http.TimeFormat))
+		}
+		names := make([]string, 0, len(hdr))
+		for name := range hdr {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(bufrw, "HTTP/%d.%d %d %s\r\n", r.ProtoMajor, r.ProtoMinor, brw.status, http.StatusText(brw.status))
+		for _, name := range names {
+			for _, v := range hdr[name] {
+				fmt.Fprintf(bufrw, "%s: %s\r\n", name, headerValueReplacer.Replace(v))
+			}
+		}
+		bufrw.WriteString("\r\n")
+		length := 0
+		if r.Method != http.MethodHead {
+			length, _ = bufrw.Write(brw.body.Bytes())
+		}
+		if err := bufrw.Flush(); err != nil {
+			log.Printf("[ERR] failed to write truncated response: %s", err)
+		}
+		// Nothing went through w, so tell the access log and metrics what did.
+		if sr, ok := w.(statusReporter); ok {
+			sr.reportStatus(brw.status, length)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncate(t *testing.T) {
+	s := startServer(t, "-text", "cut short", "-allow-truncate", "-truncate-bytes", "10")
+
+	resp, err := http.Get(s.url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength != int64(len("cut short\n")+10) {
+		t.Errorf("Content-Length = %d, want %d", resp.ContentLength, len("cut short\n")+10)
+	}
+	// Headers set outside the echo handler survive the hijack.
+	if resp.Header.Get("X-Request-Id") == "" {
+		t.Errorf("response headers %v are missing X-Request-Id", resp.Header)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("reading the body = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if string(b) != "cut short\n" {
+		t.Errorf("body = %q, want %q", b, "cut short\n")
+	}
+
+	// The status line follows the request's protocol version.
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	if status, err := bufio.NewReader(conn).ReadString('\n'); err != nil || status != "HTTP/1.0 200 OK\r\n" {
+		t.Errorf("HTTP/1.0 status line = %q, %v", status, err)
+	}
+
+	// The access log has what was written to the connection.
+	s.stop(t)
+	lines := s.accessLogLines(t)
+	if len(lines) != 2 {
+		t.Fatalf("access log has %d lines, want 2", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `" 200 10 `) {
+			t.Errorf("access log line %q, want status 200 and 10 bytes", line)
+		}
+	}
+
+	if _, stderr, code := runMain(t, "-text", "hi", "-truncate-bytes", "10"); code != 127 || !strings.Contains(stderr, "-allow-truncate") {
+		t.Errorf("-truncate-bytes without -allow-truncate: exit %d, stderr %q", code, stderr)
+	}
+}
+
+func TestTruncateWithoutHijack(t *testing.T) {
+	h := withTruncate(realClock{}, 10, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "whole")
+	})
+	// httptest.ResponseRecorder can't be hijacked, so the response is sent
+	// in full.
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "whole" {
+		t.Errorf("response = %d %q, want 200 %q", rec.Code, rec.Body.String(), "whole")
+	}
+}
+
+func TestTruncateDate(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv := httptest.NewServer(withTruncate(newFakeClock(now), 1, func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Header.Get("Date"), now.Format(http.TimeFormat); got != want {
+		t.Errorf("Date = %q, want %q from the clock", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// withTTFBDelay holds back the start of each response from h by d, without
+// slowing down anything written after it.
+func withTTFBDelay(c clock, d time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &ttfbWriter{ResponseWriter: w, clock: c, delay: d, done: r.Context().Done()}
+		h.ServeHTTP(tw, r)
+		// A handler that writes nothing still gets its headers delayed.
+		tw.wait()
+	})
+}
+
+// ttfbWriter waits out delay before the first Write or Flush, which is when
+// the response first reaches the client.
+type ttfbWriter struct {
+	http.ResponseWriter
+	clock  clock
+	delay  time.Duration
+	done   <-chan struct{}
+	waited bool
+}
+
+// wait sleeps for the delay the first time it is called, or until the
+// request is canceled.
+func (w *ttfbWriter) wait() {
+	if w.waited {
+		return
+	}
+	w.waited = true
+	select {
+	case <-w.clock.After(w.delay):
+	case <-w.done:
+	}
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *ttfbWriter) Write(b []byte) (int, error) {
+	w.wait()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements the http.Flusher interface.
+func (w *ttfbWriter) Flush() {
+	w.wait()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface when the underlying writer
+// supports it. Hijacked connections are not delayed.
+func (w *ttfbWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.waited = true
+	return hj.Hijack()
+}
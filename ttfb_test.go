@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+)
+
+func TestTTFBDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	srv := httptest.NewServer(withTTFBDelay(realClock{}, delay, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "chunk\n")
+			w.(http.Flusher).Flush()
+		}
+	})))
+	defer srv.Close()
+
+	var firstByte time.Time
+	trace := &httptrace.ClientTrace{GotFirstResponseByte: func() { firstByte = time.Now() }}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	end := time.Now()
+
+	if len(b) != 5*len("chunk\n") {
+		t.Errorf("body is %d bytes, want %d", len(b), 5*len("chunk\n"))
+	}
+	if ttfb := firstByte.Sub(start); ttfb < delay {
+		t.Errorf("first byte after %s, want at least %s", ttfb, delay)
+	}
+	// Only the first byte waits; the rest follows straight after.
+	if rest := end.Sub(firstByte); rest > delay/2 {
+		t.Errorf("rest of the body took %s after the first byte", rest)
+	}
+}
+
+func TestTTFBDelayWaitsOnce(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	cases := []struct {
+		name string
+		h    http.HandlerFunc
+	}{
+		{"several writes", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "a")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "b")
+		}},
+		// Headers alone are still held back.
+		{"no body", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}},
+	}
+
+	for _, tc := range cases {
+		before := c.Now()
+		withTTFBDelay(c, time.Second, tc.h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if waited := c.Now().Sub(before); waited != time.Second {
+			t.Errorf("%s: waited %s, want 1s", tc.name, waited)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the build version, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// versionString describes the build version, Go version and, when the binary
+// was built from a VCS checkout, the revision.
+func versionString() string {
+	s := fmt.Sprintf("http-echo %s (%s", version, runtime.Version())
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				s += ", revision " + setting.Value
+			}
+		}
+	}
+	return s + ")"
+}